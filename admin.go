@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const (
+	ADMIN_OUTFLOW_PATH = "/admin/rooms/{id}/outflow"
+	// header carrying the admin token, Authorization being left to the basic
+	// auth of web.config.file
+	ADMIN_TOKEN_HEADER = "X-Admin-Token"
+	// largest body accepted by admin endpoints, in bytes
+	ADMIN_MAX_BODY_SIZE = 4 << 10
+)
+
+// Audit outcomes
+const (
+	AUDIT_APPLIED      = "applied"
+	AUDIT_DRY_RUN      = "dry_run"
+	AUDIT_REJECTED     = "rejected"
+	AUDIT_UNAUTHORIZED = "unauthorized"
+	AUDIT_FAILED       = "failed"
+)
+
+// adminConfig holds the admin endpoint flags
+type adminConfig struct {
+	enabled    bool
+	tokenFile  string
+	minOutflow int
+	maxOutflow int
+	dryRun     bool
+}
+
+// registerFlags adds the admin endpoint flags to a flag set
+func (c *adminConfig) registerFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&c.enabled, "admin.enabled", false, "Serve "+ADMIN_OUTFLOW_PATH+" to change the max outflow of waiting rooms through the Queue-it API")
+	fs.StringVar(&c.tokenFile, "admin.token-file", "", "File holding the token admin endpoints require in the "+ADMIN_TOKEN_HEADER+" header")
+	fs.IntVar(&c.minOutflow, "admin.min-outflow", 1, "Lowest max outflow admin endpoints may set, in users per minute")
+	fs.IntVar(&c.maxOutflow, "admin.max-outflow", 1000, "Highest max outflow admin endpoints may set, in users per minute")
+	fs.BoolVar(&c.dryRun, "admin.dry-run", false, "Validate and audit admin calls without changing anything in Queue-it")
+}
+
+// outflowRequest is the body of an outflow change
+type outflowRequest struct {
+	MaxOutflow *int `json:"max_outflow"`
+	DryRun     bool `json:"dry_run"`
+}
+
+// outflowResponse is the response of an outflow change
+type outflowResponse struct {
+	WaitingRoomID      string   `json:"waiting_room_id"`
+	MaxOutflow         int      `json:"max_outflow"`
+	PreviousMaxOutflow *float64 `json:"previous_max_outflow,omitempty"`
+	DryRun             bool     `json:"dry_run"`
+}
+
+// register adds the admin endpoints to mux when they are enabled. Calls are
+// audited through logger, which should not be filtered by log.level
+func (c *adminConfig) register(mux *http.ServeMux, logger *zap.Logger, api *queueitAPI) error {
+	if !c.enabled {
+		return nil
+	}
+
+	if c.tokenFile == "" {
+		return errors.New("please provide a token file as admin.token-file to enable admin endpoints")
+	}
+
+	content, err := os.ReadFile(c.tokenFile)
+	if err != nil {
+		return errors.New("cannot read file from admin.token-file: " + c.tokenFile)
+	}
+
+	token := strings.TrimSpace(string(content))
+	if token == "" {
+		return errors.New("admin.token-file is empty")
+	}
+
+	if c.minOutflow < 0 || c.minOutflow > c.maxOutflow {
+		return fmt.Errorf("invalid admin outflow bounds [%d, %d]", c.minOutflow, c.maxOutflow)
+	}
+
+	mux.HandleFunc("POST "+ADMIN_OUTFLOW_PATH, c.outflowHandler(logger.Named("audit"), token, api))
+
+	return nil
+}
+
+// authorized reports whether a request carries the admin token
+func authorized(r *http.Request, token string) bool {
+	given := r.Header.Get(ADMIN_TOKEN_HEADER)
+	return given != "" && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// outflowHandler changes the max outflow of a waiting room within the
+// configured bounds. Every call is audited, including rejected ones
+func (c *adminConfig) outflowHandler(audit *zap.Logger, token string, api *queueitAPI) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		fields := []zap.Field{
+			zap.String("waiting_room_id", id),
+			zap.String("remote_addr", r.RemoteAddr),
+			zap.String("user_agent", r.UserAgent()),
+		}
+		fail := func(code int, outcome string, err error) {
+			audit.Warn("admin outflow change", append(fields, zap.String("outcome", outcome), zap.Error(err))...)
+			writeJSON(w, code, &apiError{Error: err.Error()})
+		}
+
+		if !authorized(r, token) {
+			fail(http.StatusUnauthorized, AUDIT_UNAUTHORIZED, errors.New("missing or invalid admin token"))
+			return
+		}
+
+		var req outflowRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, ADMIN_MAX_BODY_SIZE)).Decode(&req); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				fail(http.StatusRequestEntityTooLarge, AUDIT_REJECTED, fmt.Errorf("body is larger than %d bytes", tooLarge.Limit))
+				return
+			}
+			fail(http.StatusBadRequest, AUDIT_REJECTED, fmt.Errorf("invalid body: %w", err))
+			return
+		}
+		if req.MaxOutflow == nil {
+			fail(http.StatusBadRequest, AUDIT_REJECTED, errors.New("missing max_outflow"))
+			return
+		}
+
+		resp := &outflowResponse{WaitingRoomID: id, MaxOutflow: *req.MaxOutflow, DryRun: c.dryRun || req.DryRun}
+		fields = append(fields, zap.Int("max_outflow", resp.MaxOutflow), zap.Bool("dry_run", resp.DryRun))
+
+		if resp.MaxOutflow < c.minOutflow || resp.MaxOutflow > c.maxOutflow {
+			fail(http.StatusUnprocessableEntity, AUDIT_REJECTED, fmt.Errorf("max_outflow %d is outside of the allowed [%d, %d] range", resp.MaxOutflow, c.minOutflow, c.maxOutflow))
+			return
+		}
+
+		// the previous outflow is informative only
+		if config, err := api.getWaitingRoomConfig(r.Context(), id); err == nil {
+			previous := float64(config.MaxRedirectsPerMinute)
+			resp.PreviousMaxOutflow = &previous
+			fields = append(fields, zap.Float64("previous_max_outflow", previous))
+		}
+
+		if resp.DryRun {
+			audit.Info("admin outflow change", append(fields, zap.String("outcome", AUDIT_DRY_RUN))...)
+			writeJSON(w, http.StatusOK, resp)
+			return
+		}
+
+		if err := api.setMaxOutflow(r.Context(), id, resp.MaxOutflow); err != nil {
+			fail(http.StatusBadGateway, AUDIT_FAILED, fmt.Errorf("queue-it api call failed: %w", err))
+			return
+		}
+
+		audit.Info("admin outflow change", append(fields, zap.String("outcome", AUDIT_APPLIED))...)
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// fakeOutflowServer is a Queue-it API holding the max outflow of a single waiting room
+type fakeOutflowServer struct {
+	mu         sync.Mutex
+	maxOutflow int
+	updates    int
+	failing    bool
+}
+
+func (f *fakeOutflowServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.failing || r.URL.Path != "/2_0/event/drop" {
+		w.Write([]byte(`{"ErrorCode": 500, "ErrorText": "Internal error", "HttpStatusCode": 500}`))
+		return
+	}
+
+	if r.Method == "PUT" {
+		var body struct {
+			MaxRedirectsPerMinute stringToFloat
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.maxOutflow = int(body.MaxRedirectsPerMinute)
+		f.updates++
+	}
+
+	fmt.Fprintf(w, `{"EventId": "drop", "MaxRedirectsPerMinute": "%d"}`, f.maxOutflow)
+}
+
+func TestAdminOutflow(t *testing.T) {
+	var updates []string
+	queueit := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/2_0/event/drop" {
+			w.Write([]byte(`{"ErrorCode": 404, "ErrorText": "Event not found", "HttpStatusCode": 404}`))
+			return
+		}
+		if r.Method == "PUT" {
+			body, _ := io.ReadAll(r.Body)
+			updates = append(updates, string(body))
+		}
+		w.Write([]byte(`{"EventId": "drop", "MaxRedirectsPerMinute": "300"}`))
+	}))
+	defer queueit.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	core, logs := observer.New(zap.InfoLevel)
+	api := newQueueitAPI(context.Background(), zap.NewNop(), http.DefaultClient, queueit.URL, "a-b-c", true)
+	mux := http.NewServeMux()
+	cfg := &adminConfig{enabled: true, tokenFile: tokenFile, minOutflow: 10, maxOutflow: 1000}
+	if err := cfg.register(mux, zap.New(core), api); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		room    string
+		token   string
+		body    string
+		code    int
+		outcome string
+	}{
+		{name: "missing token", room: "drop", body: `{"max_outflow": 500}`, code: http.StatusUnauthorized, outcome: AUDIT_UNAUTHORIZED},
+		{name: "wrong token", room: "drop", token: "guess", body: `{"max_outflow": 500}`, code: http.StatusUnauthorized, outcome: AUDIT_UNAUTHORIZED},
+		{name: "invalid body", room: "drop", token: "s3cret", body: `500`, code: http.StatusBadRequest, outcome: AUDIT_REJECTED},
+		{name: "body too large", room: "drop", token: "s3cret", body: `{"max_outflow": 500, "reason": "` + strings.Repeat("x", ADMIN_MAX_BODY_SIZE) + `"}`, code: http.StatusRequestEntityTooLarge, outcome: AUDIT_REJECTED},
+		{name: "missing outflow", room: "drop", token: "s3cret", body: `{}`, code: http.StatusBadRequest, outcome: AUDIT_REJECTED},
+		{name: "below bounds", room: "drop", token: "s3cret", body: `{"max_outflow": 5}`, code: http.StatusUnprocessableEntity, outcome: AUDIT_REJECTED},
+		{name: "above bounds", room: "drop", token: "s3cret", body: `{"max_outflow": 5000}`, code: http.StatusUnprocessableEntity, outcome: AUDIT_REJECTED},
+		{name: "dry run", room: "drop", token: "s3cret", body: `{"max_outflow": 500, "dry_run": true}`, code: http.StatusOK, outcome: AUDIT_DRY_RUN},
+		{name: "applied", room: "drop", token: "s3cret", body: `{"max_outflow": 500}`, code: http.StatusOK, outcome: AUDIT_APPLIED},
+		{name: "queue-it error", room: "missing", token: "s3cret", body: `{"max_outflow": 500}`, code: http.StatusBadGateway, outcome: AUDIT_FAILED},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs.TakeAll()
+
+			req := httptest.NewRequest("POST", "/admin/rooms/"+tt.room+"/outflow", strings.NewReader(tt.body))
+			if tt.token != "" {
+				req.Header.Set(ADMIN_TOKEN_HEADER, tt.token)
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+
+			if rec.Code != tt.code {
+				t.Errorf("got status %d, want %d: %s", rec.Code, tt.code, rec.Body)
+			}
+
+			audit := logs.Filter(func(e observer.LoggedEntry) bool { return e.LoggerName == "audit" }).All()
+			if len(audit) != 1 {
+				t.Fatalf("got %d audit logs, want 1", len(audit))
+			}
+			if got := audit[0].ContextMap()["outcome"]; got != tt.outcome {
+				t.Errorf("got outcome %v, want %s", got, tt.outcome)
+			}
+		})
+	}
+
+	if len(updates) != 1 || updates[0] != `{"MaxRedirectsPerMinute":"500"}` {
+		t.Errorf("got Queue-it updates %v, want a single one to 500", updates)
+	}
+
+	// the response reports the previous outflow
+	req := httptest.NewRequest("POST", "/admin/rooms/drop/outflow", strings.NewReader(`{"max_outflow": 400, "dry_run": true}`))
+	req.Header.Set(ADMIN_TOKEN_HEADER, "s3cret")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	var resp outflowResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.PreviousMaxOutflow == nil || *resp.PreviousMaxOutflow != 300 || !resp.DryRun || resp.MaxOutflow != 400 {
+		t.Errorf("got response %+v", resp)
+	}
+}
+
+func TestAdminDisabled(t *testing.T) {
+	mux := http.NewServeMux()
+	if err := (&adminConfig{}).register(mux, zap.NewNop(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("POST", "/admin/rooms/drop/outflow", strings.NewReader(`{"max_outflow": 500}`)))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("got status %d, want 404 when admin endpoints are disabled", rec.Code)
+	}
+
+	if err := (&adminConfig{enabled: true}).register(mux, zap.NewNop(), nil); err == nil {
+		t.Error("expected an error without a token file")
+	}
+}
+
+func TestAdminBehindBasicAuth(t *testing.T) {
+	queueit := &fakeOutflowServer{maxOutflow: 300}
+	server := httptest.NewServer(queueit)
+	defer server.Close()
+
+	dir := t.TempDir()
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	webConfigFile := filepath.Join(dir, "web-config.yml")
+	if err := os.WriteFile(webConfigFile, []byte(fmt.Sprintf("basic_auth_users:\n  prometheus: %s\n", hash)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tokenFile := filepath.Join(dir, "token")
+	if err := os.WriteFile(tokenFile, []byte("s3cret"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// grab a free port for the server to listen on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	l.Close()
+
+	api := newQueueitAPI(context.Background(), zap.NewNop(), http.DefaultClient, server.URL, "a-b-c", true)
+	mux := http.NewServeMux()
+	admin := &adminConfig{enabled: true, tokenFile: tokenFile, minOutflow: 10, maxOutflow: 1000}
+	if err := admin.register(mux, zap.NewNop(), api); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &serverConfig{listenAddress: address, shutdownTimeout: time.Second, webConfigFile: webConfigFile}
+	ctx, cancel := context.WithCancel(context.Background())
+	shutdownCtx, cancelShutdown := cfg.shutdownContext(ctx)
+	defer cancelShutdown()
+	done := make(chan error, 1)
+	go func() {
+		done <- serve(ctx, shutdownCtx, zap.NewNop(), newServer(cfg, mux), cfg)
+	}()
+
+	tests := []struct {
+		name      string
+		basicAuth bool
+		token     string
+		want      int
+	}{
+		{name: "basic auth and admin token", basicAuth: true, token: "s3cret", want: http.StatusOK},
+		{name: "basic auth only", basicAuth: true, want: http.StatusUnauthorized},
+		{name: "admin token only", token: "s3cret", want: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		var resp *http.Response
+		// wait for the server to start listening
+		for i := 0; i < 50; i++ {
+			req, _ := http.NewRequest("POST", "http://"+address+"/admin/rooms/drop/outflow", strings.NewReader(`{"max_outflow": 500}`))
+			if tt.basicAuth {
+				req.SetBasicAuth("prometheus", "secret")
+			}
+			if tt.token != "" {
+				req.Header.Set(ADMIN_TOKEN_HEADER, tt.token)
+			}
+			if resp, err = http.DefaultClient.Do(req); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: got status %d, want %d", tt.name, resp.StatusCode, tt.want)
+		}
+	}
+
+	queueit.mu.Lock()
+	if queueit.maxOutflow != 500 {
+		t.Errorf("got max outflow %d, want 500 changed through basic auth", queueit.maxOutflow)
+	}
+	queueit.mu.Unlock()
+
+	http.DefaultClient.CloseIdleConnections()
+	cancel()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
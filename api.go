@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const (
+	API_ROOMS_PATH      = "/api/v1/rooms"
+	API_STATISTICS_PATH = "/api/v1/rooms/{id}/statistics"
+)
+
+// apiRoom is a waiting room as served by the JSON API
+type apiRoom struct {
+	ID               string    `json:"id"`
+	DisplayName      string    `json:"display_name"`
+	Phase            string    `json:"phase"`
+	QueueStatusText  string    `json:"queue_status_text"`
+	EventStartTime   time.Time `json:"event_start_time"`
+	EventEndTime     time.Time `json:"event_end_time"`
+	IsTest           bool      `json:"is_test"`
+	LastPoll         time.Time `json:"last_poll"`
+	PollDuration     float64   `json:"poll_duration_seconds"`
+	FailedStatistics int       `json:"failed_statistics"`
+	// phase changes of the room, oldest first
+	PhaseHistory []*phaseChange `json:"phase_history,omitempty"`
+}
+
+// apiStatistic is a waiting room statistic as served by the JSON API
+type apiStatistic struct {
+	Name      string     `json:"name"`
+	Statistic string     `json:"statistic"`
+	Value     float64    `json:"value"`
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// apiRooms is the response of the rooms endpoint
+type apiRooms struct {
+	PolledAt       time.Time  `json:"polled_at"`
+	Error          string     `json:"error,omitempty"`
+	DiscoveredAt   *time.Time `json:"discovered_at,omitempty"`
+	DiscoveryError string     `json:"discovery_error,omitempty"`
+	Rooms          []*apiRoom `json:"rooms"`
+}
+
+// apiRoomStatistics is the response of the room statistics endpoint
+type apiRoomStatistics struct {
+	Room       *apiRoom        `json:"room"`
+	Statistics []*apiStatistic `json:"statistics"`
+}
+
+// apiError is the response of a failed API call
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// newAPIRoom returns the JSON API representation of a polled waiting room
+func newAPIRoom(r *roomPoll) *apiRoom {
+	return &apiRoom{
+		ID:               r.room.EventID,
+		DisplayName:      r.room.DisplayName,
+		Phase:            r.room.Phase,
+		QueueStatusText:  r.room.QueueStatusText,
+		EventStartTime:   r.room.EventStartTime.Time,
+		EventEndTime:     r.room.EventEndTime.Time,
+		IsTest:           bool(r.room.IsTest),
+		LastPoll:         r.start,
+		PollDuration:     r.duration.Seconds(),
+		FailedStatistics: r.failed(),
+	}
+}
+
+// newAPIStatistic returns the JSON API representation of a metric
+func newAPIStatistic(m *queueitMetric) *apiStatistic {
+	s := &apiStatistic{Name: m.exportedMetricName, Statistic: m.queueitMetricName, Value: m.value}
+
+	if !m.timestamp.IsZero() {
+		ts := m.timestamp
+		s.Timestamp = &ts
+	}
+
+	if m.err != nil {
+		s.Error = m.err.Error()
+	}
+
+	return s
+}
+
+// writeJSON writes v as the JSON body of a response with the given status code
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// apiRoomsHandler serves the waiting rooms of the latest poll
+func apiRoomsHandler(status *exporterStatus) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := status.latestPoll()
+		if p == nil {
+			writeJSON(w, http.StatusServiceUnavailable, &apiError{Error: "no poll yet"})
+			return
+		}
+
+		resp := &apiRooms{PolledAt: p.start, Rooms: make([]*apiRoom, 0, len(p.rooms))}
+		if p.err != nil {
+			resp.Error = p.err.Error()
+		}
+		if p.discovered {
+			discoveredAt := p.discoveredAt
+			resp.DiscoveredAt = &discoveredAt
+		}
+		if p.discoveryErr != nil {
+			resp.DiscoveryError = p.discoveryErr.Error()
+		}
+
+		for _, room := range p.rooms {
+			apiRoom := newAPIRoom(room)
+			apiRoom.PhaseHistory = status.phaseHistory(room.room.EventID)
+			resp.Rooms = append(resp.Rooms, apiRoom)
+		}
+
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+// apiStatisticsHandler serves every statistic of a waiting room from the latest poll
+func apiStatisticsHandler(status *exporterStatus) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := status.latestPoll()
+		if p == nil {
+			writeJSON(w, http.StatusServiceUnavailable, &apiError{Error: "no poll yet"})
+			return
+		}
+
+		id := r.PathValue("id")
+		for _, room := range p.rooms {
+			if room.room.EventID != id {
+				continue
+			}
+
+			resp := &apiRoomStatistics{Room: newAPIRoom(room), Statistics: make([]*apiStatistic, 0, len(room.metrics))}
+			for _, m := range room.metrics {
+				resp.Statistics = append(resp.Statistics, newAPIStatistic(m))
+			}
+			sort.Slice(resp.Statistics, func(i, j int) bool { return resp.Statistics[i].Name < resp.Statistics[j].Name })
+
+			writeJSON(w, http.StatusOK, resp)
+			return
+		}
+
+		writeJSON(w, http.StatusNotFound, &apiError{Error: "waiting room " + id + " was not polled"})
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAPIStatisticsHandler(t *testing.T) {
+	status := newExporterStatus()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+API_STATISTICS_PATH, apiStatisticsHandler(status))
+
+	// no poll yet
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/rooms/drop/statistics", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d before the first poll", rec.Code)
+	}
+
+	ts := time.Date(2022, 3, 1, 10, 0, 0, 0, time.UTC)
+	status.record(&poll{
+		start:      ts,
+		discovered: true,
+		rooms: []*roomPoll{{
+			room:  WaitingRoom{EventID: "drop", Phase: "queue"},
+			start: ts,
+			metrics: []*queueitMetric{
+				{exportedMetricName: "queue_it_total_queue_count", queueitMetricName: "TotalQueueCount", value: 42, timestamp: ts},
+				{exportedMetricName: "queue_it_max_out_flow", queueitMetricName: "maxoutflow", err: errors.New("boom")},
+			},
+		}},
+	})
+
+	type test struct {
+		path string
+		want int
+	}
+	tests := []test{
+		{path: "/api/v1/rooms/drop/statistics", want: http.StatusOK},
+		{path: "/api/v1/rooms/other/statistics", want: http.StatusNotFound},
+	}
+
+	for _, tc := range tests {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", tc.path, nil))
+		if rec.Code != tc.want {
+			t.Errorf("%s: got status %d, want %d", tc.path, rec.Code, tc.want)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/rooms/drop/statistics", nil))
+
+	var got apiRoomStatistics
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Room.FailedStatistics != 1 || len(got.Statistics) != 2 {
+		t.Fatalf("unexpected response %s", rec.Body.String())
+	}
+
+	// statistics are sorted by name
+	if got.Statistics[0].Error != "boom" || got.Statistics[1].Timestamp == nil || !got.Statistics[1].Timestamp.Equal(ts) {
+		t.Errorf("unexpected statistics %s", rec.Body.String())
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	OUTPUT_TABLE = "table"
+	OUTPUT_JSON  = "json"
+)
+
+// command is an operator subcommand sharing the exporter's queueitAPI client
+type command struct {
+	description string
+	run         func(args []string) int
+}
+
+// commands maps subcommand names to their implementation
+var commands = map[string]*command{
+	"list-rooms":   {description: "Print the discovered waiting rooms", run: runListRooms},
+	"dump":         {description: "Print every summary and detail statistic of a waiting room once", run: runDump},
+	"check":        {description: "Verify connectivity and credentials against the Queue-it API", run: runCheck},
+	"dashboard":    {description: "Print a Grafana dashboard of the exporter's metrics", run: runDashboard},
+	"rules":        {description: "Print Prometheus recording and alerting rules for the exporter's metrics", run: runRules},
+	"push":         {description: "Poll every waiting room once and push the metrics to a Pushgateway", run: runPush},
+	"remote-write": {description: "Poll every waiting room once and write the samples to a Prometheus remote write endpoint", run: runRemoteWrite},
+}
+
+// printCommands writes the available subcommands and their description
+func printCommands(w io.Writer) {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-12s %s\n", name, commands[name].description)
+	}
+}
+
+// commandConfig holds the flags shared by every subcommand
+type commandConfig struct {
+	queueit queueitConfig
+	log     logConfig
+	output  string
+}
+
+// commandContext holds what every subcommand needs once its flags are parsed
+type commandContext struct {
+	logger *zap.Logger
+	api    *queueitAPI
+	output string
+	stdout io.Writer
+}
+
+// newCommandFlagSet returns a flag set registering the Queue-it API, logging and output flags
+func newCommandFlagSet(name string, cfg *commandConfig) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	cfg.queueit.registerFlags(fs)
+	cfg.log.registerFlags(fs)
+	fs.StringVar(&cfg.output, "output", OUTPUT_TABLE, "Output format, one of table or json")
+	return fs
+}
+
+// newCommandContext validates the parsed flags and builds a queueitAPI
+func newCommandContext(cfg *commandConfig) (*commandContext, error) {
+	if cfg.output != OUTPUT_TABLE && cfg.output != OUTPUT_JSON {
+		return nil, fmt.Errorf("unknown output format %q", cfg.output)
+	}
+
+	logger, err := cfg.log.newLogger()
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Transport: cfg.log.wrapTransport(logger, http.DefaultTransport)}
+	api, err := cfg.queueit.newAPI(context.Background(), logger, client)
+	if err != nil {
+		return nil, err
+	}
+
+	return &commandContext{
+		logger: logger,
+		api:    api,
+		output: cfg.output,
+		stdout: os.Stdout,
+	}, nil
+}
+
+// exitCode prints a subcommand error and returns its exit code
+func exitCode(err error) int {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+
+	return 0
+}
+
+// runListRooms prints the waiting rooms the exporter would collect metrics for
+func runListRooms(args []string) int {
+	var cfg commandConfig
+
+	fs := newCommandFlagSet("list-rooms", &cfg)
+	fs.Parse(args)
+
+	cc, err := newCommandContext(&cfg)
+	if err != nil {
+		return exitCode(err)
+	}
+	defer cc.logger.Sync()
+
+	rooms, err := cc.api.getOpenWaitingRooms(context.Background())
+	if err != nil {
+		return exitCode(err)
+	}
+
+	return exitCode(cc.printRooms(rooms))
+}
+
+// printRooms writes waiting rooms in the configured output format
+func (cc *commandContext) printRooms(rooms []WaitingRoom) error {
+	if cc.output == OUTPUT_JSON {
+		return json.NewEncoder(cc.stdout).Encode(rooms)
+	}
+
+	w := tabwriter.NewWriter(cc.stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tSTATUS\tSTART\tEND\tTEST")
+	for _, wr := range rooms {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%t\n",
+			wr.EventID,
+			wr.DisplayName,
+			wr.QueueStatusText,
+			wr.EventStartTime.Format(time.RFC3339),
+			wr.EventEndTime.Format(time.RFC3339),
+			bool(wr.IsTest),
+		)
+	}
+
+	return w.Flush()
+}
+
+// dumpedStatistic is the printed representation of a queueitMetric
+type dumpedStatistic struct {
+	Name      string  `json:"name"`
+	Statistic string  `json:"statistic"`
+	Value     float64 `json:"value"`
+}
+
+// runDump prints every summary and detail statistic of a waiting room once
+func runDump(args []string) int {
+	var cfg commandConfig
+	var room string
+
+	fs := newCommandFlagSet("dump", &cfg)
+	fs.StringVar(&room, "room", "", "ID of the waiting room to dump statistics for")
+	fs.Parse(args)
+
+	if room == "" {
+		return exitCode(errors.New("please provide a waiting room ID as -room"))
+	}
+
+	cc, err := newCommandContext(&cfg)
+	if err != nil {
+		return exitCode(err)
+	}
+	defer cc.logger.Sync()
+
+	metrics, err := cc.api.getWaitingRoomsMetrics(context.Background(), []WaitingRoom{{EventID: room}})
+	if err != nil {
+		return exitCode(err)
+	}
+
+	return exitCode(cc.printStatistics(metrics))
+}
+
+// printStatistics writes metrics sorted by exported name in the configured output format
+func (cc *commandContext) printStatistics(metrics []*queueitMetric) error {
+	stats := make([]dumpedStatistic, 0, len(metrics))
+	for _, m := range metrics {
+		stats = append(stats, dumpedStatistic{Name: m.exportedMetricName, Statistic: m.queueitMetricName, Value: m.value})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+
+	if cc.output == OUTPUT_JSON {
+		return json.NewEncoder(cc.stdout).Encode(stats)
+	}
+
+	w := tabwriter.NewWriter(cc.stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSTATISTIC\tVALUE")
+	for _, s := range stats {
+		fmt.Fprintf(w, "%s\t%s\t%g\n", s.Name, s.Statistic, s.Value)
+	}
+
+	return w.Flush()
+}
+
+// runCheck verifies the Queue-it API is reachable with the configured credentials.
+// It exits non-zero on failure so it can gate init containers
+func runCheck(args []string) int {
+	var cfg commandConfig
+
+	fs := newCommandFlagSet("check", &cfg)
+	fs.Parse(args)
+
+	cc, err := newCommandContext(&cfg)
+	if err != nil {
+		return exitCode(err)
+	}
+	defer cc.logger.Sync()
+
+	rooms, err := cc.api.getOpenWaitingRooms(context.Background())
+	if err != nil {
+		return exitCode(fmt.Errorf("queue-it api check failed: %w", err))
+	}
+
+	if cc.output == OUTPUT_JSON {
+		return exitCode(json.NewEncoder(cc.stdout).Encode(map[string]interface{}{"ok": true, "waiting_rooms": len(rooms)}))
+	}
+
+	fmt.Fprintf(cc.stdout, "ok: found %d waiting rooms\n", len(rooms))
+
+	return 0
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestPrintStatistics(t *testing.T) {
+	out := &bytes.Buffer{}
+	cc := &commandContext{output: OUTPUT_JSON, stdout: out}
+
+	input := []*queueitMetric{
+		{exportedMetricName: "queue_it_queue_outflow_count", queueitMetricName: "queueoutflow", value: 12},
+		{exportedMetricName: "queue_it_max_out_flow", queueitMetricName: "maxoutflow", value: 100},
+	}
+
+	if err := cc.printStatistics(input); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []dumpedStatistic
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 2 || got[0].Statistic != "maxoutflow" || got[1].Value != 12 {
+		t.Errorf("unexpected statistics %v", got)
+	}
+}
@@ -8,29 +8,56 @@ import (
 )
 
 var (
-	up = prometheus.NewDesc(
-		"queue_it_up",
-		"Was talking to Queue-it successful.",
-		nil, nil,
+	upDefinition = &metricDefinition{
+		name: "queue_it_up",
+		help: "Was talking to Queue-it successful.",
+	}
+	durationDefinition = &metricDefinition{
+		name: "queue_it_collector_collect_duration_seconds",
+		help: "Duration of the last collection of Queue-it metrics.",
+	}
+	roomInfoDefinition = &metricDefinition{
+		name:   "queue_it_waiting_room_info",
+		help:   "A metric with a constant '1' value labeled by the display name and phase of discovered waiting rooms.",
+		labels: []string{"waiting_room_id", "display_name", "phase"},
+	}
+	secondsUntilStartDefinition = roomMetricDefinition(
+		"queue_it_waiting_room_seconds_until_start",
+		"Time until the event start time of discovered waiting rooms, negative once the event started.",
 	)
-	duration = prometheus.NewDesc(
-		"queue_it_collector_collect_duration_seconds",
-		"Was talking to Queue-it successful.",
-		nil, nil,
+	lastPollDefinition = roomMetricDefinition(
+		"queue_it_waiting_room_last_poll_timestamp_seconds",
+		"Unix time of the poll the statistics of a waiting room were last fetched by, older than the collection when the room was not due for a new poll.",
 	)
+
+	up                = upDefinition.desc()
+	duration          = durationDefinition.desc()
+	roomInfo          = roomInfoDefinition.desc()
+	secondsUntilStart = secondsUntilStartDefinition.desc()
+	lastPoll          = lastPollDefinition.desc()
 )
 
+// pollObserver is notified of the outcome of every collection. observe must not block
+type pollObserver interface {
+	observe(p *poll)
+}
+
 type collector struct {
 	logger     *zap.Logger
 	queueitAPI *queueitAPI
+	status     *exporterStatus
+	observers  []pollObserver
 }
 
-// newCollector returns a queueitAPI connector
-func newCollector(logger *zap.Logger, api *queueitAPI) *collector {
+// newCollector returns a queueitAPI connector recording the outcome of
+// every collection to status and observers
+func newCollector(logger *zap.Logger, api *queueitAPI, status *exporterStatus, observers ...pollObserver) *collector {
 	logger.Debug("newCollector()")
 	return &collector{
 		logger:     logger,
 		queueitAPI: api,
+		status:     status,
+		observers:  observers,
 	}
 }
 
@@ -51,37 +78,110 @@ func (c *collector) Collect(ch chan<- prometheus.Metric) {
 		now := time.Now()
 		ch <- prometheus.MustNewConstMetric(
 			duration,
-			prometheus.CounterValue,
+			prometheus.GaugeValue,
 			float64(now.Sub(start).Seconds()),
 		)
 	}()
 
 	// Get metrics
-	metrics, err := c.queueitAPI.getMetrics()
+	p := c.queueitAPI.poll()
+	c.status.record(p)
+	for _, o := range c.observers {
+		o.observe(p)
+	}
+
+	c.export(p, start, ch)
+}
+
+// export sends the metrics of a poll, now being the time they are sent at
+func (c *collector) export(p *poll, now time.Time, ch chan<- prometheus.Metric) {
+	// discovered rooms are exported even when some of their statistics failed
+	for _, r := range p.rooms {
+		ch <- prometheus.MustNewConstMetric(roomInfo, prometheus.GaugeValue, 1, r.room.EventID, r.room.DisplayName, r.room.Phase)
+		if !r.room.EventStartTime.IsZero() {
+			ch <- prometheus.MustNewConstMetric(secondsUntilStart, prometheus.GaugeValue, r.room.EventStartTime.Sub(now).Seconds(), r.room.EventID)
+		}
+		if r.config != nil {
+			for _, m := range roomConfigMetrics(r.config, r.room.EventID) {
+				ch <- m
+			}
+		}
+	}
+
+	_, err := p.metrics()
 	if err != nil {
 		c.logger.Error("error", zap.Error(err))
 		// Queue-it api is unreachable
 		ch <- prometheus.MustNewConstMetric(up, prometheus.GaugeValue, 0)
+
+		// keep series continuous across a restart until a poll succeeds,
+		// with the time they were last polled at
+		if restored := c.status.restoredPoll(); restored != nil {
+			restoredMetrics, _ := restored.metrics()
+			for _, m := range restoredMetrics {
+				ch <- prometheus.NewMetricWithTimestamp(restored.start, newGauge(m))
+			}
+		}
 		return
 	}
 
 	// Contacted Queue-it api successfully
 	ch <- prometheus.MustNewConstMetric(up, prometheus.GaugeValue, 1)
 
-	// Send metrics
-	for _, m := range metrics {
-		ch <- prometheus.MustNewConstMetric(
-			prometheus.NewDesc(
-				m.exportedMetricName,
-				m.description,
-				[]string{"waiting_room_id"},
-				nil,
-			),
-			prometheus.GaugeValue,
-			m.value,
-			m.waitingRoomID,
-		)
+	// Send metrics. Reused ones carry no timestamp, so they do not fall out
+	// of the Prometheus lookback when polls are further apart than it; their
+	// age is told by the time of their poll instead
+	for _, r := range p.rooms {
+		if len(r.metrics) == 0 {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(lastPoll, prometheus.GaugeValue, float64(r.start.UnixNano())/1e9, r.room.EventID)
+		for _, m := range r.metrics {
+			ch <- newGauge(m)
+		}
 	}
 
 	c.logger.Debug("collector.Collect(): Finished collecting")
 }
+
+// latest returns a collector exporting the last poll of c instead of polling
+// again, unless it is older than maxAge. Pushes alongside scrapes then don't
+// add requests to the Queue-it API
+func (c *collector) latest(maxAge time.Duration) *latestPollCollector {
+	return &latestPollCollector{collector: c, maxAge: maxAge}
+}
+
+// latestPollCollector exports the last poll of a collector
+type latestPollCollector struct {
+	collector *collector
+	maxAge    time.Duration
+}
+
+// Describe implements Collector. It is unchecked so registering it does not poll Queue-it
+func (l *latestPollCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect implements Collector
+func (l *latestPollCollector) Collect(ch chan<- prometheus.Metric) {
+	status := l.collector.status
+
+	// a restored poll is not the outcome of a collection
+	p := status.latestPoll()
+	if p == nil || p == status.restoredPoll() || time.Since(p.start) > l.maxAge {
+		l.collector.Collect(ch)
+		return
+	}
+
+	l.collector.logger.Debug("latestPollCollector.Collect(): exporting the last poll", zap.Time("start", p.start))
+	ch <- prometheus.MustNewConstMetric(duration, prometheus.GaugeValue, p.duration.Seconds())
+	l.collector.export(p, time.Now(), ch)
+}
+
+// newGauge returns the gauge exporting a Queue-it metric
+func newGauge(m *queueitMetric) prometheus.Metric {
+	return prometheus.MustNewConstMetric(
+		roomMetricDefinition(m.exportedMetricName, m.description).desc(),
+		prometheus.GaugeValue,
+		m.value,
+		m.waitingRoomID,
+	)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// settings returns every exported setting of a waiting room configuration by
+// snake_cased field name
+func (c *WaitingRoomConfig) settings() map[string]string {
+	settings := make(map[string]string, len(roomSettings)+len(roomInfoSettings))
+
+	for _, s := range roomSettings {
+		settings[s.label] = strconv.FormatFloat(s.value(c), 'g', -1, 64)
+	}
+	for _, s := range roomInfoSettings {
+		settings[s.label] = s.value(c)
+	}
+
+	return settings
+}
+
+// hashSettings returns a digest of settings that changes with any of their values
+func hashSettings(settings map[string]string) string {
+	fields := make([]string, 0, len(settings))
+	for field := range settings {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	h := sha256.New()
+	for _, field := range fields {
+		h.Write([]byte(field))
+		h.Write([]byte{0})
+		h.Write([]byte(settings[field]))
+		h.Write([]byte{0})
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// settingChange is a setting whose value changed between two polls
+type settingChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+// knownSettings is the last known configuration of a waiting room
+type knownSettings struct {
+	hash     string
+	settings map[string]string
+}
+
+// configDrift counts and logs waiting room configuration changes between polls
+type configDrift struct {
+	logger  *zap.Logger
+	changes *prometheus.CounterVec
+
+	mu sync.Mutex
+	// last known settings by waiting room ID, kept while a room is discovered
+	rooms map[string]*knownSettings
+}
+
+var configChangesDefinition = &metricDefinition{
+	name:   "queue_it_waiting_room_config_changes_total",
+	help:   "Number of changes of waiting room configuration settings seen between polls.",
+	labels: []string{"waiting_room_id", "field"},
+}
+
+// newConfigDrift returns a configDrift that has not seen any configuration yet
+func newConfigDrift(logger *zap.Logger) *configDrift {
+	return &configDrift{
+		logger:  logger,
+		changes: configChangesDefinition.counterVec(),
+		rooms:   make(map[string]*knownSettings),
+	}
+}
+
+// register registers the drift metrics to a registerer
+func (d *configDrift) register(reg prometheus.Registerer) {
+	reg.MustRegister(d.changes)
+}
+
+// observe implements pollObserver. The first configuration fetched for a room
+// is its baseline, rooms that are no longer discovered are forgotten
+func (d *configDrift) observe(p *poll) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if p.discovered {
+		discovered := make(map[string]bool, len(p.rooms))
+		for _, r := range p.rooms {
+			discovered[r.room.EventID] = true
+		}
+
+		for id := range d.rooms {
+			if !discovered[id] {
+				delete(d.rooms, id)
+			}
+		}
+	}
+
+	for _, r := range p.rooms {
+		if r.config == nil {
+			continue
+		}
+
+		id := r.room.EventID
+		current := &knownSettings{settings: r.config.settings()}
+		current.hash = hashSettings(current.settings)
+
+		previous, ok := d.rooms[id]
+		d.rooms[id] = current
+		if !ok || previous.hash == current.hash {
+			continue
+		}
+
+		changes := make([]settingChange, 0)
+		for field, value := range current.settings {
+			if old := previous.settings[field]; old != value {
+				changes = append(changes, settingChange{Field: field, Old: old, New: value})
+				d.changes.WithLabelValues(id, field).Inc()
+			}
+		}
+		sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+
+		d.logger.Warn("configDrift.observe(): waiting room configuration changed",
+			zap.String("waiting_room_id", id),
+			zap.String("old_hash", previous.hash),
+			zap.String("new_hash", current.hash),
+			zap.Any("changes", changes),
+		)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestConfigDrift(t *testing.T) {
+	core, logs := observer.New(zap.WarnLevel)
+	d := newConfigDrift(zap.New(core))
+
+	pollWith := func(configs ...*WaitingRoomConfig) *poll {
+		p := &poll{discovered: true}
+		for _, c := range configs {
+			p.rooms = append(p.rooms, &roomPoll{room: WaitingRoom{EventID: c.EventID}, config: c})
+		}
+		return p
+	}
+
+	drop := &WaitingRoomConfig{EventID: "drop", TargetUrl: "https://shop.example.com", MaxRedirectsPerMinute: 300}
+	other := &WaitingRoomConfig{EventID: "other", MaxRedirectsPerMinute: 100}
+
+	// baseline
+	d.observe(pollWith(drop, other))
+	// unchanged
+	d.observe(pollWith(drop, other))
+	// failed configuration fetch keeps the last known configuration
+	d.observe(&poll{discovered: true, rooms: []*roomPoll{{room: WaitingRoom{EventID: "drop"}}}})
+	// outflow and target URL changed mid-drop
+	d.observe(pollWith(&WaitingRoomConfig{EventID: "drop", TargetUrl: "https://shop.example.com/sale", MaxRedirectsPerMinute: 500}, other))
+
+	if got := testutil.ToFloat64(d.changes.WithLabelValues("drop", "max_redirects_per_minute")); got != 1 {
+		t.Errorf("got %v max_redirects_per_minute changes, want 1", got)
+	}
+	if got := testutil.ToFloat64(d.changes.WithLabelValues("drop", "target_url")); got != 1 {
+		t.Errorf("got %v target_url changes, want 1", got)
+	}
+	if got := testutil.CollectAndCount(d.changes); got != 2 {
+		t.Errorf("got %d changed fields, want 2", got)
+	}
+
+	if logs.Len() != 1 {
+		t.Fatalf("got %d change logs, want 1", logs.Len())
+	}
+
+	changes, ok := logs.All()[0].ContextMap()["changes"].([]settingChange)
+	if !ok || len(changes) != 2 || changes[0] != (settingChange{Field: "max_redirects_per_minute", Old: "300", New: "500"}) {
+		t.Errorf("got logged changes %v", logs.All()[0].ContextMap()["changes"])
+	}
+
+	// a room that is no longer discovered is forgotten, and is a new baseline when it reappears
+	d.observe(pollWith(other))
+	if _, ok := d.rooms["drop"]; ok {
+		t.Error("drop is still known after it was not discovered")
+	}
+	// a failed discovery forgets nothing
+	d.observe(&poll{})
+	d.observe(pollWith(drop, other))
+	if logs.Len() != 1 {
+		t.Errorf("got %d change logs, want no change logged for a reappearing room", logs.Len())
+	}
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	promapi "github.com/prometheus/client_golang/api"
+	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"go.uber.org/zap"
+)
+
+// Controller decisions and their reasons
+const (
+	DECISION_INCREASE   = "increase"
+	DECISION_DECREASE   = "decrease"
+	DECISION_HOLD       = "hold"
+	REASON_HEALTHY      = "healthy"
+	REASON_UNHEALTHY    = "unhealthy"
+	REASON_AT_BOUND     = "at_bound"
+	REASON_COOLDOWN     = "cooldown"
+	REASON_KILL_SWITCH  = "kill_switch"
+	REASON_SIGNAL_ERROR = "signal_error"
+	REASON_API_ERROR    = "api_error"
+)
+
+// controllerConfig holds the outflow controller flags
+type controllerConfig struct {
+	waitingRoomID  string
+	prometheusURL  string
+	query          string
+	threshold      float64
+	healthURL      string
+	signalTimeout  time.Duration
+	minOutflow     int
+	maxOutflow     int
+	stepUp         int
+	stepDown       int
+	interval       time.Duration
+	cooldown       time.Duration
+	killSwitchFile string
+	dryRun         bool
+}
+
+// registerFlags adds the outflow controller flags to a flag set
+func (c *controllerConfig) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.waitingRoomID, "controller.waiting-room-id", "", "Waiting room whose max outflow is adjusted to the health of the protected site, controller off when empty")
+	fs.StringVar(&c.prometheusURL, "controller.prometheus-url", "", "Prometheus server evaluating controller.query")
+	fs.StringVar(&c.query, "controller.query", "", "PromQL query returning a single value, the site is healthy while it is at most controller.threshold")
+	fs.Float64Var(&c.threshold, "controller.threshold", 0, "Highest controller.query value of a healthy site")
+	fs.StringVar(&c.healthURL, "controller.health-url", "", "HTTP health endpoint of the protected site, healthy while it answers with a 2xx status")
+	fs.DurationVar(&c.signalTimeout, "controller.signal-timeout", 10*time.Second, "Timeout of a single health signal request")
+	fs.IntVar(&c.minOutflow, "controller.min-outflow", 1, "Lowest max outflow the controller may set, in users per minute")
+	fs.IntVar(&c.maxOutflow, "controller.max-outflow", 1000, "Highest max outflow the controller may set, in users per minute")
+	fs.IntVar(&c.stepUp, "controller.step-up", 50, "Largest max outflow increase of a single decision while the site is healthy")
+	fs.IntVar(&c.stepDown, "controller.step-down", 100, "Largest max outflow decrease of a single decision while the site is unhealthy")
+	fs.DurationVar(&c.interval, "controller.interval", 30*time.Second, "Interval between two controller decisions")
+	fs.DurationVar(&c.cooldown, "controller.cooldown", 2*time.Minute, "Minimum time between two max outflow changes, also waited after startup. Decreases of an unhealthy site do not wait")
+	fs.StringVar(&c.killSwitchFile, "controller.kill-switch-file", "", "The controller holds the max outflow while this file exists")
+	fs.BoolVar(&c.dryRun, "controller.dry-run", false, "Take and export controller decisions without changing anything in Queue-it")
+}
+
+// healthSignal tells whether the site protected by a waiting room is healthy
+type healthSignal interface {
+	// check returns the signal value and whether it is healthy
+	check(ctx context.Context) (float64, bool, error)
+}
+
+// promqlSignal is healthy while a PromQL query value is at most a threshold
+type promqlSignal struct {
+	api       promv1.API
+	query     string
+	threshold float64
+}
+
+func (s *promqlSignal) check(ctx context.Context) (float64, bool, error) {
+	result, _, err := s.api.Query(ctx, s.query, time.Now())
+	if err != nil {
+		return 0, false, err
+	}
+
+	var value float64
+	switch r := result.(type) {
+	case *model.Scalar:
+		value = float64(r.Value)
+	case model.Vector:
+		if len(r) != 1 {
+			return 0, false, fmt.Errorf("query returned %d series instead of 1", len(r))
+		}
+		value = float64(r[0].Value)
+	default:
+		return 0, false, fmt.Errorf("unsupported query result type %s", result.Type())
+	}
+
+	if math.IsNaN(value) {
+		return value, false, errors.New("query returned NaN")
+	}
+
+	return value, value <= s.threshold, nil
+}
+
+// httpSignal is healthy while an endpoint answers with a 2xx status. Its
+// value is the response status code
+type httpSignal struct {
+	client *http.Client
+	url    string
+}
+
+func (s *httpSignal) check(ctx context.Context) (float64, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", s.url, nil)
+	if err != nil {
+		return 0, false, err
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, false, err
+	}
+	resp.Body.Close()
+
+	return float64(resp.StatusCode), resp.StatusCode >= 200 && resp.StatusCode < 300, nil
+}
+
+// newSignal returns the health signal selected by the configuration
+func (c *controllerConfig) newSignal() (healthSignal, error) {
+	client := &http.Client{Timeout: c.signalTimeout}
+
+	switch {
+	case c.query != "" && c.healthURL != "":
+		return nil, errors.New("controller.query and controller.health-url are mutually exclusive")
+	case c.query != "":
+		if c.prometheusURL == "" {
+			return nil, errors.New("please provide a Prometheus server as controller.prometheus-url to evaluate controller.query")
+		}
+
+		promClient, err := promapi.NewClient(promapi.Config{Address: c.prometheusURL, Client: client})
+		if err != nil {
+			return nil, fmt.Errorf("invalid controller.prometheus-url: %w", err)
+		}
+
+		return &promqlSignal{api: promv1.NewAPI(promClient), query: c.query, threshold: c.threshold}, nil
+	case c.healthURL != "":
+		return &httpSignal{client: client, url: c.healthURL}, nil
+	default:
+		return nil, errors.New("please provide a health signal as controller.query or controller.health-url")
+	}
+}
+
+// newController validates the configuration and returns an outflowController.
+// It returns a nil controller when no waiting room is configured
+func (c *controllerConfig) newController(logger *zap.Logger, api *queueitAPI) (*outflowController, error) {
+	if c.waitingRoomID == "" {
+		return nil, nil
+	}
+
+	if c.minOutflow < 0 || c.minOutflow > c.maxOutflow {
+		return nil, fmt.Errorf("invalid controller outflow bounds [%d, %d]", c.minOutflow, c.maxOutflow)
+	}
+
+	if c.stepUp <= 0 || c.stepDown <= 0 {
+		return nil, errors.New("controller.step-up and controller.step-down must be positive")
+	}
+
+	if c.interval <= 0 {
+		return nil, errors.New("controller.interval must be positive")
+	}
+
+	signal, err := c.newSignal()
+	if err != nil {
+		return nil, err
+	}
+
+	return newOutflowController(logger, api, signal, c), nil
+}
+
+// controllerDecision is the outcome of a single controller step
+type controllerDecision struct {
+	decision string
+	reason   string
+	// max outflow before and after the decision, 0 when unknown
+	from int
+	to   int
+	// whether the change was only logged, not applied
+	dryRun bool
+}
+
+// outflowController adjusts the max outflow of a waiting room to the health
+// of the site it protects, one bounded step at a time
+type outflowController struct {
+	logger *zap.Logger
+	api    *queueitAPI
+	signal healthSignal
+	cfg    *controllerConfig
+	now    func() time.Time
+
+	decisions  *prometheus.CounterVec
+	value      *prometheus.GaugeVec
+	healthy    *prometheus.GaugeVec
+	outflow    *prometheus.GaugeVec
+	killSwitch *prometheus.GaugeVec
+	lastChange *prometheus.GaugeVec
+
+	mu sync.Mutex
+	// time of the last max outflow change, startup time until the first one
+	// when running, as changes made before a restart are unknown
+	changed time.Time
+}
+
+var (
+	controllerDecisionsDefinition = &metricDefinition{
+		name:   "queue_it_controller_decisions_total",
+		help:   "Number of outflow controller decisions by decision and reason.",
+		labels: []string{"waiting_room_id", "decision", "reason"},
+	}
+	controllerValueDefinition = roomMetricDefinition(
+		"queue_it_controller_signal_value",
+		"Value of the health signal at the last controller decision.",
+	)
+	controllerHealthyDefinition = roomMetricDefinition(
+		"queue_it_controller_signal_healthy",
+		"Whether the health signal was healthy at the last controller decision.",
+	)
+	controllerOutflowDefinition = roomMetricDefinition(
+		"queue_it_controller_max_outflow",
+		"Max outflow of the waiting room after the last controller decision, in users redirected per minute.",
+	)
+	controllerKillSwitchDefinition = roomMetricDefinition(
+		"queue_it_controller_kill_switch_engaged",
+		"Whether the controller kill switch was engaged at the last controller decision.",
+	)
+	controllerLastChangeDefinition = roomMetricDefinition(
+		"queue_it_controller_last_change_timestamp_seconds",
+		"Unix time of the last max outflow change made by the controller.",
+	)
+	controllerDefinitions = []*metricDefinition{controllerDecisionsDefinition, controllerValueDefinition, controllerHealthyDefinition, controllerOutflowDefinition, controllerKillSwitchDefinition, controllerLastChangeDefinition}
+)
+
+// newOutflowController returns an outflowController that has not changed anything yet
+func newOutflowController(logger *zap.Logger, api *queueitAPI, signal healthSignal, cfg *controllerConfig) *outflowController {
+	return &outflowController{
+		logger:     logger,
+		api:        api,
+		signal:     signal,
+		cfg:        cfg,
+		now:        time.Now,
+		decisions:  controllerDecisionsDefinition.counterVec(),
+		value:      controllerValueDefinition.gaugeVec(),
+		healthy:    controllerHealthyDefinition.gaugeVec(),
+		outflow:    controllerOutflowDefinition.gaugeVec(),
+		killSwitch: controllerKillSwitchDefinition.gaugeVec(),
+		lastChange: controllerLastChangeDefinition.gaugeVec(),
+	}
+}
+
+// register registers the controller metrics to a registerer
+func (o *outflowController) register(reg prometheus.Registerer) {
+	reg.MustRegister(o.decisions, o.value, o.healthy, o.outflow, o.killSwitch, o.lastChange)
+}
+
+// run takes a decision every interval, the first one an interval after it is
+// called, until ctx is done. Startup counts as a change for the cooldown, so a
+// restarted controller does not undo the cooldown of a change it forgot
+func (o *outflowController) run(ctx context.Context) {
+	o.mu.Lock()
+	o.changed = o.now()
+	o.mu.Unlock()
+
+	ticker := time.NewTicker(o.cfg.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		o.step(ctx)
+	}
+}
+
+// killSwitchEngaged reports whether the kill switch file exists
+func (o *outflowController) killSwitchEngaged() bool {
+	if o.cfg.killSwitchFile == "" {
+		return false
+	}
+
+	_, err := os.Stat(o.cfg.killSwitchFile)
+	return err == nil
+}
+
+// step takes a single decision, applies it and exports it
+func (o *outflowController) step(ctx context.Context) *controllerDecision {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	d := o.decide(ctx)
+
+	id := o.cfg.waitingRoomID
+	o.decisions.WithLabelValues(id, d.decision, d.reason).Inc()
+	if d.dryRun {
+		o.outflow.WithLabelValues(id).Set(float64(d.from))
+	} else if d.to > 0 {
+		o.outflow.WithLabelValues(id).Set(float64(d.to))
+	}
+
+	fields := []zap.Field{
+		zap.String("waiting_room_id", id),
+		zap.String("decision", d.decision),
+		zap.String("reason", d.reason),
+		zap.Int("from", d.from),
+		zap.Int("to", d.to),
+	}
+	switch {
+	case d.decision == DECISION_HOLD:
+		o.logger.Debug("outflowController.step(): holding max outflow", fields...)
+	case d.dryRun:
+		o.logger.Info("outflowController.step(): would change max outflow, dry run", fields...)
+	default:
+		o.logger.Info("outflowController.step(): changed max outflow", fields...)
+	}
+
+	return d
+}
+
+// decide reads the health signal and the current max outflow, and changes the
+// max outflow when allowed to
+func (o *outflowController) decide(ctx context.Context) *controllerDecision {
+	id := o.cfg.waitingRoomID
+
+	engaged := o.killSwitchEngaged()
+	o.killSwitch.WithLabelValues(id).Set(boolValue(engaged))
+	if engaged {
+		return &controllerDecision{decision: DECISION_HOLD, reason: REASON_KILL_SWITCH}
+	}
+
+	// read the max outflow every time so manual changes are picked up
+	config, err := o.api.getWaitingRoomConfig(ctx, id)
+	if err != nil {
+		o.logger.Warn("outflowController.decide(): cannot read waiting room configuration", zap.String("waiting_room_id", id), zap.Error(err))
+		return &controllerDecision{decision: DECISION_HOLD, reason: REASON_API_ERROR}
+	}
+	current := int(config.MaxRedirectsPerMinute)
+	d := &controllerDecision{decision: DECISION_HOLD, from: current, to: current}
+
+	value, healthy, err := o.signal.check(ctx)
+	if err != nil {
+		o.logger.Warn("outflowController.decide(): cannot read health signal", zap.String("waiting_room_id", id), zap.Error(err))
+		d.reason = REASON_SIGNAL_ERROR
+		return d
+	}
+	o.value.WithLabelValues(id).Set(value)
+	o.healthy.WithLabelValues(id).Set(boolValue(healthy))
+
+	target := current - o.cfg.stepDown
+	d.reason = REASON_UNHEALTHY
+	if healthy {
+		target = current + o.cfg.stepUp
+		d.reason = REASON_HEALTHY
+	}
+	// a max outflow set outside of the bounds is brought back within them
+	target = min(max(target, o.cfg.minOutflow), o.cfg.maxOutflow)
+
+	if target == current {
+		d.reason = REASON_AT_BOUND
+		return d
+	}
+
+	// relieving an unhealthy site does not wait for the cooldown
+	if (healthy || target > current) && !o.changed.IsZero() && o.now().Sub(o.changed) < o.cfg.cooldown {
+		d.reason = REASON_COOLDOWN
+		return d
+	}
+
+	if o.cfg.dryRun {
+		d.dryRun = true
+	} else if err := o.api.setMaxOutflow(ctx, id, target); err != nil {
+		o.logger.Warn("outflowController.decide(): cannot change max outflow", zap.String("waiting_room_id", id), zap.Error(err))
+		d.reason = REASON_API_ERROR
+		return d
+	}
+
+	// dry run changes count for the cooldown too, so they are paced like real ones
+	o.changed = o.now()
+	if !d.dryRun {
+		o.lastChange.WithLabelValues(id).Set(float64(o.changed.Unix()))
+	}
+
+	d.to = target
+	d.decision = DECISION_INCREASE
+	if target < current {
+		d.decision = DECISION_DECREASE
+	}
+
+	return d
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+// fakeSignal is a health signal returning preset results
+type fakeSignal struct {
+	value   float64
+	healthy bool
+	err     error
+}
+
+func (s *fakeSignal) check(ctx context.Context) (float64, bool, error) {
+	return s.value, s.healthy, s.err
+}
+
+func TestOutflowController(t *testing.T) {
+	queueit := &fakeOutflowServer{maxOutflow: 280}
+	server := httptest.NewServer(queueit)
+	defer server.Close()
+
+	killSwitch := filepath.Join(t.TempDir(), "kill")
+	cfg := &controllerConfig{
+		waitingRoomID:  "drop",
+		minOutflow:     100,
+		maxOutflow:     300,
+		stepUp:         50,
+		stepDown:       100,
+		cooldown:       time.Minute,
+		killSwitchFile: killSwitch,
+	}
+
+	api := newQueueitAPI(context.Background(), zap.NewNop(), http.DefaultClient, server.URL, "a-b-c", true)
+	signal := &fakeSignal{value: 0.1, healthy: true}
+	o := newOutflowController(zap.NewNop(), api, signal, cfg)
+
+	now := time.Unix(1646128800, 0)
+	o.now = func() time.Time { return now }
+
+	steps := []struct {
+		name     string
+		setup    func()
+		decision string
+		reason   string
+		outflow  int
+	}{
+		{name: "healthy step up capped at max", decision: DECISION_INCREASE, reason: REASON_HEALTHY, outflow: 300},
+		{name: "healthy at max", setup: func() { now = now.Add(2 * time.Minute) }, decision: DECISION_HOLD, reason: REASON_AT_BOUND, outflow: 300},
+		{name: "unhealthy step down", setup: func() { signal.healthy, signal.value = false, 0.9 }, decision: DECISION_DECREASE, reason: REASON_UNHEALTHY, outflow: 200},
+		{name: "unhealthy within cooldown", setup: func() { now = now.Add(30 * time.Second) }, decision: DECISION_DECREASE, reason: REASON_UNHEALTHY, outflow: 100},
+		{name: "healthy within cooldown", setup: func() { now, signal.healthy, signal.value = now.Add(30*time.Second), true, 0.1 }, decision: DECISION_HOLD, reason: REASON_COOLDOWN, outflow: 100},
+		{name: "healthy step up", setup: func() { now = now.Add(time.Minute) }, decision: DECISION_INCREASE, reason: REASON_HEALTHY, outflow: 150},
+		{name: "signal error", setup: func() { now, signal.err = now.Add(2*time.Minute), errors.New("no data") }, decision: DECISION_HOLD, reason: REASON_SIGNAL_ERROR, outflow: 150},
+		{name: "kill switch", setup: func() {
+			signal.err, signal.healthy = nil, true
+			if err := os.WriteFile(killSwitch, nil, 0o600); err != nil {
+				t.Fatal(err)
+			}
+		}, decision: DECISION_HOLD, reason: REASON_KILL_SWITCH, outflow: 150},
+		{name: "manual change out of bounds", setup: func() {
+			os.Remove(killSwitch)
+			queueit.maxOutflow = 1000
+		}, decision: DECISION_DECREASE, reason: REASON_HEALTHY, outflow: 300},
+		{name: "queue-it error", setup: func() {
+			now = now.Add(2 * time.Minute)
+			queueit.failing = true
+		}, decision: DECISION_HOLD, reason: REASON_API_ERROR, outflow: 300},
+	}
+
+	for _, s := range steps {
+		if s.setup != nil {
+			s.setup()
+		}
+
+		d := o.step(context.Background())
+		if d.decision != s.decision || d.reason != s.reason {
+			t.Errorf("%s: got decision %s (%s), want %s (%s)", s.name, d.decision, d.reason, s.decision, s.reason)
+		}
+		if queueit.maxOutflow != s.outflow {
+			t.Errorf("%s: got max outflow %d, want %d", s.name, queueit.maxOutflow, s.outflow)
+		}
+	}
+
+	if queueit.updates != 5 {
+		t.Errorf("got %d max outflow updates, want 5", queueit.updates)
+	}
+
+	if got := testutil.ToFloat64(o.decisions.WithLabelValues("drop", DECISION_DECREASE, REASON_UNHEALTHY)); got != 2 {
+		t.Errorf("got %v unhealthy decreases, want 2", got)
+	}
+	if got := testutil.ToFloat64(o.outflow.WithLabelValues("drop")); got != 300 {
+		t.Errorf("got controller max outflow %v, want 300", got)
+	}
+	if got := testutil.ToFloat64(o.killSwitch.WithLabelValues("drop")); got != 0 {
+		t.Errorf("got kill switch %v, want 0", got)
+	}
+	if got := testutil.ToFloat64(o.lastChange.WithLabelValues("drop")); got != float64(now.Add(-2*time.Minute).Unix()) {
+		t.Errorf("got last change %v", got)
+	}
+}
+
+func TestOutflowControllerDryRun(t *testing.T) {
+	queueit := &fakeOutflowServer{maxOutflow: 200}
+	server := httptest.NewServer(queueit)
+	defer server.Close()
+
+	cfg := &controllerConfig{waitingRoomID: "drop", minOutflow: 100, maxOutflow: 300, stepUp: 50, stepDown: 100, cooldown: time.Minute, dryRun: true}
+	api := newQueueitAPI(context.Background(), zap.NewNop(), http.DefaultClient, server.URL, "a-b-c", true)
+	o := newOutflowController(zap.NewNop(), api, &fakeSignal{healthy: true}, cfg)
+
+	d := o.step(context.Background())
+	if d.decision != DECISION_INCREASE || !d.dryRun || d.to != 250 {
+		t.Errorf("got decision %+v, want a dry run increase to 250", d)
+	}
+	if queueit.updates != 0 {
+		t.Errorf("got %d max outflow updates in dry run", queueit.updates)
+	}
+	if got := testutil.ToFloat64(o.outflow.WithLabelValues("drop")); got != 200 {
+		t.Errorf("got controller max outflow %v, want the unchanged 200", got)
+	}
+	if got := testutil.CollectAndCount(o.lastChange); got != 0 {
+		t.Errorf("got %d last change series in dry run", got)
+	}
+
+	// dry run changes are paced by the cooldown
+	if d := o.step(context.Background()); d.reason != REASON_COOLDOWN {
+		t.Errorf("got second decision %+v, want a cooldown hold", d)
+	}
+}
+
+func TestOutflowControllerStartup(t *testing.T) {
+	tests := []struct {
+		name     string
+		healthy  bool
+		decision string
+		reason   string
+		updates  int
+	}{
+		{name: "increases wait for the cooldown", healthy: true, decision: DECISION_HOLD, reason: REASON_COOLDOWN, updates: 0},
+		{name: "unhealthy decreases do not wait", healthy: false, decision: DECISION_DECREASE, reason: REASON_UNHEALTHY, updates: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queueit := &fakeOutflowServer{maxOutflow: 200}
+			server := httptest.NewServer(queueit)
+			defer server.Close()
+
+			cfg := &controllerConfig{waitingRoomID: "drop", minOutflow: 100, maxOutflow: 300, stepUp: 50, stepDown: 100, interval: 20 * time.Millisecond, cooldown: time.Hour}
+			api := newQueueitAPI(context.Background(), zap.NewNop(), http.DefaultClient, server.URL, "a-b-c", true)
+			o := newOutflowController(zap.NewNop(), api, &fakeSignal{healthy: tt.healthy}, cfg)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			start := time.Now()
+			done := make(chan struct{})
+			go func() {
+				o.run(ctx)
+				close(done)
+			}()
+
+			for testutil.CollectAndCount(o.decisions) == 0 {
+				time.Sleep(time.Millisecond)
+			}
+			if elapsed := time.Since(start); elapsed < cfg.interval {
+				t.Errorf("got a first decision after %s, want one interval", elapsed)
+			}
+			cancel()
+			<-done
+
+			if got := testutil.ToFloat64(o.decisions.WithLabelValues("drop", tt.decision, tt.reason)); got < 1 {
+				t.Errorf("got no %s (%s) decision", tt.decision, tt.reason)
+			}
+			queueit.mu.Lock()
+			defer queueit.mu.Unlock()
+			if queueit.updates != tt.updates {
+				t.Errorf("got %d max outflow updates, want %d", queueit.updates, tt.updates)
+			}
+		})
+	}
+}
+
+func TestControllerSignals(t *testing.T) {
+	prometheus := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch r.Form.Get("query") {
+		case "error_ratio":
+			w.Write([]byte(`{"status": "success", "data": {"resultType": "vector", "result": [{"metric": {}, "value": [1646128800, "0.02"]}]}}`))
+		case "scalar(error_ratio)":
+			w.Write([]byte(`{"status": "success", "data": {"resultType": "scalar", "result": [1646128800, "0.2"]}}`))
+		default:
+			w.Write([]byte(`{"status": "success", "data": {"resultType": "vector", "result": []}}`))
+		}
+	}))
+	defer prometheus.Close()
+
+	health := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer health.Close()
+
+	tests := []struct {
+		name    string
+		cfg     controllerConfig
+		value   float64
+		healthy bool
+		err     bool
+	}{
+		{name: "vector below threshold", cfg: controllerConfig{prometheusURL: prometheus.URL, query: "error_ratio", threshold: 0.05}, value: 0.02, healthy: true},
+		{name: "scalar above threshold", cfg: controllerConfig{prometheusURL: prometheus.URL, query: "scalar(error_ratio)", threshold: 0.05}, value: 0.2},
+		{name: "empty vector", cfg: controllerConfig{prometheusURL: prometheus.URL, query: "missing"}, err: true},
+		{name: "healthy endpoint", cfg: controllerConfig{healthURL: health.URL + "/healthz"}, value: 200, healthy: true},
+		{name: "unhealthy endpoint", cfg: controllerConfig{healthURL: health.URL + "/down"}, value: 503},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signal, err := tt.cfg.newSignal()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			value, healthy, err := signal.check(context.Background())
+			if (err != nil) != tt.err {
+				t.Fatalf("got error %v", err)
+			}
+			if value != tt.value || healthy != tt.healthy {
+				t.Errorf("got value %v healthy %v, want %v %v", value, healthy, tt.value, tt.healthy)
+			}
+		})
+	}
+
+	if _, err := (&controllerConfig{query: "error_ratio"}).newSignal(); err == nil {
+		t.Error("expected an error without a Prometheus server")
+	}
+	if _, err := (&controllerConfig{prometheusURL: prometheus.URL, query: "error_ratio", healthURL: health.URL}).newSignal(); err == nil {
+		t.Error("expected an error with two signals")
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+const DASHBOARD_ROOM_FILTER = `{waiting_room_id=~"$waiting_room_id"}`
+
+// dashboardConfig holds the flags of the dashboard subcommand
+type dashboardConfig struct {
+	title   string
+	uid     string
+	refresh string
+}
+
+// registerFlags adds the dashboard flags to a flag set
+func (c *dashboardConfig) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.title, "title", "Queue-it", "Title of the dashboard")
+	fs.StringVar(&c.uid, "uid", "queue-it-exporter", "UID of the dashboard")
+	fs.StringVar(&c.refresh, "refresh", "30s", "Refresh interval of the dashboard")
+}
+
+// dashboardTarget is a Prometheus query of a Grafana panel
+type dashboardTarget struct {
+	Expr         string `json:"expr"`
+	LegendFormat string `json:"legendFormat"`
+	RefID        string `json:"refId"`
+}
+
+// dashboardPanel is a Grafana time series panel
+type dashboardPanel struct {
+	ID          int                    `json:"id"`
+	Type        string                 `json:"type"`
+	Title       string                 `json:"title"`
+	Description string                 `json:"description,omitempty"`
+	Datasource  map[string]string      `json:"datasource"`
+	GridPos     map[string]int         `json:"gridPos"`
+	FieldConfig map[string]interface{} `json:"fieldConfig"`
+	Targets     []dashboardTarget      `json:"targets"`
+}
+
+// datasource references the dashboard's datasource variable
+var datasource = map[string]string{"type": "prometheus", "uid": "${datasource}"}
+
+// series is a metric plotted per waiting room
+type series struct {
+	metric string
+	legend string
+}
+
+// newPanel returns a panel plotting every series per waiting room
+func newPanel(id int, title string, description string, unit string, x int, y int, s ...series) dashboardPanel {
+	p := dashboardPanel{
+		ID:          id,
+		Type:        "timeseries",
+		Title:       title,
+		Description: description,
+		Datasource:  datasource,
+		GridPos:     map[string]int{"h": 8, "w": 12, "x": x, "y": y},
+		FieldConfig: map[string]interface{}{"defaults": map[string]interface{}{"unit": unit}, "overrides": []interface{}{}},
+	}
+
+	for i, s := range s {
+		p.Targets = append(p.Targets, dashboardTarget{
+			Expr:         mustMetric(s.metric) + DASHBOARD_ROOM_FILTER,
+			LegendFormat: "{{waiting_room_id}} " + s.legend,
+			RefID:        string(rune('A' + i)),
+		})
+	}
+
+	return p
+}
+
+// dashboard returns a Grafana dashboard of the exporter's metrics
+func (c *dashboardConfig) dashboard() map[string]interface{} {
+	info := mustMetric("queue_it_waiting_room_info")
+
+	panels := []dashboardPanel{
+		newPanel(1, "Queue size", "Users waiting in the queue", "short", 0, 0,
+			series{"queue_it_total_waiting_in_queue_count", "waiting"},
+			series{"queue_it_queue_ids_in_queue_count", "queue IDs"},
+		),
+		newPanel(2, "Inflow / outflow", "Users joining and redirected out of the queue per minute", "short", 12, 0,
+			series{"queue_it_queue_inflow_count", "inflow"},
+			series{"queue_it_queue_outflow_count", "outflow"},
+			series{"queue_it_max_out_flow", "max outflow"},
+		),
+		newPanel(3, "Wait time", "Expected and actual wait time and their gap in minutes", "m", 0, 8,
+			series{"queue_it_queue_expected_wait_time", "expected"},
+			series{"queue_it_queue_actual_wait_time", "actual"},
+			series{"queue_it_queue_wait_time_gap_minutes", "gap"},
+		),
+		newPanel(4, "Redirects", "Redirects to the target site over the last minute", "short", 12, 8,
+			series{"queue_it_no_of_redirects_last_minute", "redirects"},
+			series{"queue_it_no_of_unique_redirects_last_minute", "unique redirects"},
+		),
+		newPanel(5, "Estimated drain time", "Time to drain the queue at the current outflow", "s", 0, 16,
+			series{"queue_it_estimated_drain_time_seconds", "drain time"},
+		),
+		newPanel(6, "Outflow utilization", "Share of the maximum outflow in use", "percentunit", 12, 16,
+			series{"queue_it_max_outflow_utilization_ratio", "utilization"},
+		),
+	}
+
+	return map[string]interface{}{
+		"uid":           c.uid,
+		"title":         c.title,
+		"tags":          []string{"queue-it"},
+		"editable":      true,
+		"schemaVersion": 39,
+		"refresh":       c.refresh,
+		"time":          map[string]string{"from": "now-6h", "to": "now"},
+		"templating": map[string]interface{}{"list": []interface{}{
+			map[string]interface{}{
+				"name":  "datasource",
+				"label": "Datasource",
+				"type":  "datasource",
+				"query": "prometheus",
+			},
+			map[string]interface{}{
+				"name":       "waiting_room_id",
+				"label":      "Waiting room",
+				"type":       "query",
+				"datasource": datasource,
+				"query":      fmt.Sprintf("label_values(%s, waiting_room_id)", info),
+				"refresh":    2,
+				"multi":      true,
+				"includeAll": true,
+				"current":    map[string]interface{}{"text": "All", "value": "$__all"},
+			},
+		}},
+		"annotations": map[string]interface{}{"list": []interface{}{
+			map[string]interface{}{
+				"name":       "Phase changes",
+				"datasource": datasource,
+				"enable":     true,
+				"iconColor":  "orange",
+				// a phase change starts a new info series
+				"expr":        fmt.Sprintf("%s%s unless %s offset 2m", info, DASHBOARD_ROOM_FILTER, info),
+				"step":        "60s",
+				"titleFormat": "{{display_name}} entered {{phase}}",
+				"tagKeys":     "waiting_room_id,phase",
+			},
+		}},
+		"panels": panels,
+	}
+}
+
+// writeDashboard writes the dashboard as Grafana JSON
+func (c *dashboardConfig) writeDashboard(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(c.dashboard())
+}
+
+// runDashboard prints a Grafana dashboard of the exporter's metrics
+func runDashboard(args []string) int {
+	var cfg dashboardConfig
+
+	fs := flag.NewFlagSet("dashboard", flag.ExitOnError)
+	cfg.registerFlags(fs)
+	fs.Parse(args)
+
+	return exitCode(cfg.writeDashboard(os.Stdout))
+}
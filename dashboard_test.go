@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+func TestDashboard(t *testing.T) {
+	cfg := &dashboardConfig{title: "Queue-it", uid: "queue-it", refresh: "30s"}
+
+	var buf bytes.Buffer
+	if err := cfg.writeDashboard(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var dashboard struct {
+		Templating struct {
+			List []struct{ Name string }
+		}
+		Annotations struct {
+			List []struct{ Expr string }
+		}
+		Panels []struct {
+			Title   string
+			Targets []struct{ Expr string }
+		}
+	}
+	if err := json.Unmarshal(buf.Bytes(), &dashboard); err != nil {
+		t.Fatal(err)
+	}
+
+	var hasRoomVariable bool
+	for _, v := range dashboard.Templating.List {
+		hasRoomVariable = hasRoomVariable || v.Name == "waiting_room_id"
+	}
+	if !hasRoomVariable {
+		t.Error("missing waiting_room_id template variable")
+	}
+
+	// Grafana interpolates variables before sending queries to Prometheus
+	parse := func(expr string) {
+		if _, err := parser.ParseExpr(strings.ReplaceAll(expr, "$waiting_room_id", ".*")); err != nil {
+			t.Errorf("invalid query %q: %v", expr, err)
+		}
+	}
+
+	titles := map[string]bool{}
+	for _, p := range dashboard.Panels {
+		titles[p.Title] = true
+		for _, target := range p.Targets {
+			parse(target.Expr)
+		}
+	}
+	for _, a := range dashboard.Annotations.List {
+		parse(a.Expr)
+	}
+
+	for _, title := range []string{"Queue size", "Inflow / outflow", "Wait time", "Redirects"} {
+		if !titles[title] {
+			t.Errorf("missing %q panel", title)
+		}
+	}
+}
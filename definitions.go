@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metricDefinition is a metric exported by the exporter. Collectors build
+// their metrics from definitions, and generated rules and dashboards only
+// reference defined metrics, so they stay in sync with the exporter
+type metricDefinition struct {
+	name   string
+	help   string
+	labels []string
+}
+
+// perRoom reports whether a metric is exported for every waiting room, or
+// for the exporter itself
+func (d *metricDefinition) perRoom() bool {
+	return slices.Contains(d.labels, "waiting_room_id")
+}
+
+// desc returns the description of a metric
+func (d *metricDefinition) desc() *prometheus.Desc {
+	return prometheus.NewDesc(d.name, d.help, d.labels, nil)
+}
+
+// counterVec returns a counter vector exporting a metric
+func (d *metricDefinition) counterVec() *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{Name: d.name, Help: d.help}, d.labels)
+}
+
+// gaugeVec returns a gauge vector exporting a metric
+func (d *metricDefinition) gaugeVec() *prometheus.GaugeVec {
+	return prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: d.name, Help: d.help}, d.labels)
+}
+
+// roomMetricDefinition returns the definition of a gauge exported per waiting room
+func roomMetricDefinition(name string, help string) *metricDefinition {
+	return &metricDefinition{name: name, help: help, labels: []string{"waiting_room_id"}}
+}
+
+// metricDefinitions returns every metric the exporter may export whatever
+// the enabled features, sorted by name. They are computed once
+var metricDefinitions = sync.OnceValue(func() []*metricDefinition {
+	defs := []*metricDefinition{
+		upDefinition,
+		durationDefinition,
+		roomInfoDefinition,
+		secondsUntilStartDefinition,
+		lastPollDefinition,
+		roomConfigInfoDefinition,
+		buildInfoDefinition,
+		flowDriftDefinition,
+		configChangesDefinition,
+		webhookDeliveriesDefinition,
+		discoveryAgeDefinition,
+		discoveredRoomsDefinition,
+		discoveryFailuresDefinition,
+		roomPollIntervalDefinition,
+	}
+	defs = append(defs, apiDefinitions...)
+	defs = append(defs, controllerDefinitions...)
+
+	summary := make(chan *queueitMetric, SUMMARY_METRIC_COUNT)
+	(&queueitAPI{}).sendSummaryMetrics(&StatisticsSummary{}, "", summary)
+	for n := 0; n < SUMMARY_METRIC_COUNT; n++ {
+		m := <-summary
+		defs = append(defs, roomMetricDefinition(m.exportedMetricName, m.description))
+	}
+
+	for _, m := range statisticsDetailsMetrics {
+		defs = append(defs, roomMetricDefinition(m.exportedMetricName, m.description))
+	}
+
+	for _, d := range derivedMetrics {
+		defs = append(defs, roomMetricDefinition(d.exportedMetricName, d.description))
+	}
+
+	for _, s := range roomSettings {
+		defs = append(defs, roomMetricDefinition(s.exportedMetricName, s.description))
+	}
+
+	for _, m := range flowCounterMetrics {
+		defs = append(defs, m.definition())
+	}
+
+	sort.Slice(defs, func(i, j int) bool { return defs[i].name < defs[j].name })
+
+	return defs
+})
+
+// mustMetric returns name if the exporter exports such a metric and panics otherwise
+func mustMetric(name string) string {
+	for _, d := range metricDefinitions() {
+		if d.name == name {
+			return name
+		}
+	}
+
+	panic(fmt.Sprintf("queue-it exporter does not export %s", name))
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// TestMetricDefinitionsMatchRegistry checks every queue_it metric gathered
+// from a registry wired like the exporter's is defined, with the same help
+func TestMetricDefinitionsMatchRegistry(t *testing.T) {
+	start := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/2_0/event/search":
+			w.Write([]byte(`[{"EventId": "drop", "Phase": "prequeue", "IsTest": "False", "PreQueueStartsMinuesBefore": "120", "EventStartTime": "` + start + `"}]`))
+		case strings.HasSuffix(r.URL.Path, "/queue/statistics/summary"):
+			w.Write([]byte(`{"TotalQueueCount": "42", "TotalWaitingInQueueCount": "10"}`))
+		case strings.Contains(r.URL.Path, "/queue/statistics/details/"):
+			w.Write([]byte(`{"Entries": [{"Sum": "1"}], "SumOffset": "10"}`))
+		default:
+			w.Write([]byte(`{"EventId": "drop", "MaxRedirectsPerMinute": "300"}`))
+		}
+	}))
+	defer server.Close()
+
+	registry := newRegistry()
+	apiMetrics := newAPIMetrics()
+	apiMetrics.register(registry)
+
+	client := &http.Client{Transport: apiMetrics.instrument(http.DefaultTransport)}
+	api := newQueueitAPI(context.Background(), zap.NewNop(), client, server.URL, "a-b-c", true)
+	api.fetchRoomConfig = true
+	api.discovery, _ = (&discoveryConfig{refreshInterval: time.Minute, ttl: time.Minute}).newCache()
+	api.schedule = (&pollingConfig{eventWindow: true}).newSchedule()
+	api.flowCounters = newFlowCounters(zap.NewNop())
+	registry.MustRegister(api.discovery, api.schedule)
+	api.flowCounters.register(registry)
+
+	drift := newConfigDrift(zap.NewNop())
+	drift.register(registry)
+	registry.MustRegister(newCollector(zap.NewNop(), api, newExporterStatus(), api.flowCounters, drift))
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defs := make(map[string]*metricDefinition)
+	for _, d := range metricDefinitions() {
+		defs[d.name] = d
+	}
+
+	gathered := 0
+	for _, f := range families {
+		if !strings.HasPrefix(f.GetName(), "queue_it_") {
+			continue
+		}
+		gathered++
+
+		d, ok := defs[f.GetName()]
+		if !ok {
+			t.Errorf("%s is exported but not defined", f.GetName())
+			continue
+		}
+		if d.help != f.GetHelp() {
+			t.Errorf("%s: got help %q, want %q", f.GetName(), d.help, f.GetHelp())
+		}
+		for _, m := range f.GetMetric() {
+			names := make(map[string]bool)
+			for _, l := range m.GetLabel() {
+				names[l.GetName()] = true
+			}
+			for _, l := range d.labels {
+				if !names[l] {
+					t.Errorf("%s: defined label %s is not exported", f.GetName(), l)
+				}
+			}
+		}
+	}
+
+	// the poll exported statistics, flow counters and settings
+	if gathered < 40 {
+		t.Errorf("gathered %d queue_it metrics, want a full poll", gathered)
+	}
+}
+
+func TestMetricDefinitionsPerRoom(t *testing.T) {
+	for _, d := range metricDefinitions() {
+		switch d.name {
+		case "queue_it_up", "queue_it_api_requests_total", "queue_it_exporter_build_info":
+			if d.perRoom() {
+				t.Errorf("%s is not per waiting room", d.name)
+			}
+		case "queue_it_waiting_room_info", "queue_it_controller_max_outflow", "queue_it_total_queue_count":
+			if !d.perRoom() {
+				t.Errorf("%s is per waiting room", d.name)
+			}
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import "strings"
+
+// derivedMetric is a gauge computed from two statistics of a waiting room
+type derivedMetric struct {
+	exportedMetricName string
+	description        string
+	numerator          string
+	denominator        string
+	// compute returns the value and whether it is defined
+	compute func(numerator float64, denominator float64) (float64, bool)
+}
+
+// ratio divides numerator by denominator, undefined when denominator is 0
+func ratio(numerator float64, denominator float64) (float64, bool) {
+	if denominator == 0 {
+		return 0, false
+	}
+
+	return numerator / denominator, true
+}
+
+// derivedMetrics are exported for every waiting room along the statistics they are computed from
+var derivedMetrics = []*derivedMetric{
+	{
+		exportedMetricName: "queue_it_estimated_drain_time_seconds",
+		description:        "Estimated time to drain the queue at the current outflow, TotalWaitingInQueueCount / queueoutflow. Absent when the outflow is 0 and users are waiting",
+		numerator:          "TotalWaitingInQueueCount",
+		denominator:        "queueoutflow",
+		compute: func(waiting float64, outflowPerMinute float64) (float64, bool) {
+			if waiting == 0 {
+				return 0, true
+			}
+
+			minutes, ok := ratio(waiting, outflowPerMinute)
+			return minutes * 60, ok
+		},
+	},
+	{
+		exportedMetricName: "queue_it_inflow_outflow_ratio",
+		description:        "Users joining the queue per user redirected out of it over the last minute, queueinflow / queueoutflow",
+		numerator:          "queueinflow",
+		denominator:        "queueoutflow",
+		compute:            ratio,
+	},
+	{
+		exportedMetricName: "queue_it_max_outflow_utilization_ratio",
+		description:        "Share of the maximum outflow used over the last minute, queueoutflow / maxoutflow",
+		numerator:          "queueoutflow",
+		denominator:        "maxoutflow",
+		compute:            ratio,
+	},
+	{
+		exportedMetricName: "queue_it_queue_wait_time_gap_minutes",
+		description:        "Expected minus actual wait time in minutes, queueexpectedwaittime - queueactualwaittime",
+		numerator:          "queueexpectedwaittime",
+		denominator:        "queueactualwaittime",
+		compute: func(expected float64, actual float64) (float64, bool) {
+			return expected - actual, true
+		},
+	},
+}
+
+// deriveMetrics returns the derived metrics of a waiting room from its
+// statistics. Metrics whose inputs failed or that are undefined are left out
+func deriveMetrics(waitingRoomID string, metrics []*queueitMetric) []*queueitMetric {
+	values := make(map[string]float64, len(metrics))
+	for _, m := range metrics {
+		// accumulated detail metrics share the statistic name of their count
+		if m.err == nil && !strings.HasSuffix(m.exportedMetricName, "_accumulated") {
+			values[m.queueitMetricName] = m.value
+		}
+	}
+
+	derived := make([]*queueitMetric, 0, len(derivedMetrics))
+	for _, d := range derivedMetrics {
+		numerator, ok := values[d.numerator]
+		if !ok {
+			continue
+		}
+		denominator, ok := values[d.denominator]
+		if !ok {
+			continue
+		}
+
+		value, ok := d.compute(numerator, denominator)
+		if !ok {
+			continue
+		}
+
+		derived = append(derived, &queueitMetric{
+			exportedMetricName: d.exportedMetricName,
+			description:        d.description,
+			waitingRoomID:      waitingRoomID,
+			value:              value,
+		})
+	}
+
+	return derived
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDeriveMetrics(t *testing.T) {
+	type test struct {
+		name    string
+		metrics []*queueitMetric
+		want    map[string]float64
+	}
+
+	stat := func(name string, value float64) *queueitMetric {
+		return &queueitMetric{queueitMetricName: name, exportedMetricName: name, value: value}
+	}
+
+	tests := []test{
+		{
+			name: "every input",
+			metrics: []*queueitMetric{
+				stat("TotalWaitingInQueueCount", 1000),
+				stat("queueoutflow", 200),
+				stat("queueinflow", 300),
+				stat("maxoutflow", 400),
+				stat("queueexpectedwaittime", 7),
+				stat("queueactualwaittime", 5),
+			},
+			want: map[string]float64{
+				"queue_it_estimated_drain_time_seconds":  300,
+				"queue_it_inflow_outflow_ratio":          1.5,
+				"queue_it_max_outflow_utilization_ratio": 0.5,
+				"queue_it_queue_wait_time_gap_minutes":   2,
+			},
+		},
+		{
+			name: "no outflow",
+			metrics: []*queueitMetric{
+				stat("TotalWaitingInQueueCount", 1000),
+				stat("queueoutflow", 0),
+				stat("queueinflow", 300),
+				stat("maxoutflow", 400),
+			},
+			want: map[string]float64{
+				"queue_it_max_outflow_utilization_ratio": 0,
+			},
+		},
+		{
+			name: "drained",
+			metrics: []*queueitMetric{
+				stat("TotalWaitingInQueueCount", 0),
+				stat("queueoutflow", 0),
+			},
+			want: map[string]float64{
+				"queue_it_estimated_drain_time_seconds": 0,
+			},
+		},
+		{
+			name: "failed input",
+			metrics: []*queueitMetric{
+				stat("TotalWaitingInQueueCount", 1000),
+				{queueitMetricName: "queueoutflow", value: 200, err: errors.New("bad gateway")},
+			},
+			want: map[string]float64{},
+		},
+	}
+
+	for _, tc := range tests {
+		got := deriveMetrics("room1", tc.metrics)
+		if len(got) != len(tc.want) {
+			t.Errorf("%s: got %d derived metrics, want %d", tc.name, len(got), len(tc.want))
+			continue
+		}
+
+		for _, m := range got {
+			if want, ok := tc.want[m.exportedMetricName]; !ok || m.value != want || m.waitingRoomID != "room1" {
+				t.Errorf("%s: got %s{waiting_room_id=%q} %v, want %v", tc.name, m.exportedMetricName, m.waitingRoomID, m.value, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	discoveryAgeDefinition = &metricDefinition{
+		name: "queue_it_discovery_age_seconds",
+		help: "Time since waiting rooms were last discovered successfully.",
+	}
+	discoveredRoomsDefinition = &metricDefinition{
+		name: "queue_it_discovered_waiting_rooms",
+		help: "Number of waiting rooms found by the last successful discovery.",
+	}
+	discoveryFailuresDefinition = &metricDefinition{
+		name: "queue_it_discovery_failures_total",
+		help: "Number of failed waiting room discoveries.",
+	}
+
+	discoveryAge    = discoveryAgeDefinition.desc()
+	discoveredRooms = discoveredRoomsDefinition.desc()
+)
+
+// discoveryConfig holds the waiting room discovery flags
+type discoveryConfig struct {
+	refreshInterval time.Duration
+	ttl             time.Duration
+}
+
+// registerFlags adds the discovery flags to a flag set
+func (c *discoveryConfig) registerFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&c.refreshInterval, "discovery.refresh-interval", time.Minute, "Interval between two waiting room discoveries, 0 discovers waiting rooms on every poll")
+	fs.DurationVar(&c.ttl, "discovery.ttl", 15*time.Minute, "How long the last discovered waiting rooms are polled while discovery fails")
+}
+
+// newCache validates the configuration and returns a discoveryCache. It
+// returns a nil cache when waiting rooms are discovered on every poll
+func (c *discoveryConfig) newCache() (*discoveryCache, error) {
+	if c.refreshInterval <= 0 {
+		return nil, nil
+	}
+
+	if c.ttl < c.refreshInterval {
+		return nil, errors.New("discovery.ttl must be at least discovery.refresh-interval")
+	}
+
+	return &discoveryCache{
+		refreshInterval: c.refreshInterval,
+		ttl:             c.ttl,
+		now:             time.Now,
+		failures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: discoveryFailuresDefinition.name,
+			Help: discoveryFailuresDefinition.help,
+		}),
+	}, nil
+}
+
+// discoveryCache refreshes the discovered waiting rooms on its own interval,
+// and keeps serving them for up to ttl while refreshes fail
+type discoveryCache struct {
+	refreshInterval time.Duration
+	ttl             time.Duration
+	now             func() time.Time
+	failures        prometheus.Counter
+
+	mu sync.Mutex
+	// rooms of the last successful discovery
+	rooms []WaitingRoom
+	// time of the last successful discovery, zero before the first one
+	discovered time.Time
+	// time of the last discovery attempt
+	attempted time.Time
+	// closed once the refresh in flight is over, nil without any
+	refreshing chan struct{}
+	// error of the last discovery attempt, cleared by a successful one, for
+	// the calls waiting on it
+	err error
+}
+
+// Describe implements Collector
+func (d *discoveryCache) Describe(ch chan<- *prometheus.Desc) {
+	ch <- discoveryAge
+	ch <- discoveredRooms
+	d.failures.Describe(ch)
+}
+
+// Collect implements Collector
+func (d *discoveryCache) Collect(ch chan<- prometheus.Metric) {
+	d.mu.Lock()
+	discovered, rooms := d.discovered, len(d.rooms)
+	d.mu.Unlock()
+
+	if !discovered.IsZero() {
+		ch <- prometheus.MustNewConstMetric(discoveryAge, prometheus.GaugeValue, d.now().Sub(discovered).Seconds())
+		ch <- prometheus.MustNewConstMetric(discoveredRooms, prometheus.GaugeValue, float64(rooms))
+	}
+	d.failures.Collect(ch)
+}
+
+// get returns the discovered waiting rooms and when they were discovered,
+// calling discover once refreshInterval elapsed since the last attempt. Only
+// one refresh runs at a time: while it runs, other calls are served the cached
+// rooms, or wait for its outcome once those are older than ttl. The call that
+// ran a failed refresh returns its error along with rooms discovered less
+// than ttl ago; calls without any such rooms return the error and a zero time
+func (d *discoveryCache) get(ctx context.Context, discover func(ctx context.Context) ([]WaitingRoom, error)) ([]WaitingRoom, time.Time, error) {
+	d.mu.Lock()
+	now := d.now()
+	// without usable rooms every poll retries
+	if d.refreshing == nil && (d.expired(now) || now.Sub(d.attempted) >= d.refreshInterval) {
+		return d.refresh(ctx, now, discover)
+	}
+
+	if !d.expired(now) || d.refreshing == nil {
+		defer d.mu.Unlock()
+		return d.rooms, d.discovered, nil
+	}
+
+	refreshing := d.refreshing
+	d.mu.Unlock()
+
+	select {
+	case <-refreshing:
+	case <-ctx.Done():
+		return nil, time.Time{}, ctx.Err()
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.expired(d.now()) {
+		return nil, time.Time{}, d.err
+	}
+
+	return d.rooms, d.discovered, nil
+}
+
+// refresh runs discover on behalf of get, which locked the cache. The cache
+// is unlocked while discover runs
+func (d *discoveryCache) refresh(ctx context.Context, now time.Time, discover func(ctx context.Context) ([]WaitingRoom, error)) ([]WaitingRoom, time.Time, error) {
+	d.attempted = now
+	refreshing := make(chan struct{})
+	d.refreshing = refreshing
+	d.mu.Unlock()
+
+	rooms, err := discover(ctx)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.refreshing = nil
+	close(refreshing)
+	if err != nil {
+		d.failures.Inc()
+		d.err = err
+	} else {
+		d.rooms, d.discovered, d.err = rooms, now, nil
+	}
+
+	if d.expired(now) {
+		return nil, time.Time{}, err
+	}
+
+	return d.rooms, d.discovered, err
+}
+
+// expired reports whether there are no rooms discovered less than ttl ago
+func (d *discoveryCache) expired(now time.Time) bool {
+	return d.discovered.IsZero() || now.Sub(d.discovered) > d.ttl
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+func TestDiscoveryCache(t *testing.T) {
+	d, err := (&discoveryConfig{refreshInterval: time.Minute, ttl: 5 * time.Minute}).newCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2022, 3, 1, 10, 0, 0, 0, time.UTC)
+	d.now = func() time.Time { return now }
+
+	calls := 0
+	var discoverErr error
+	discover := func(ctx context.Context) ([]WaitingRoom, error) {
+		calls++
+		if discoverErr != nil {
+			return nil, discoverErr
+		}
+		return []WaitingRoom{{EventID: "drop"}}, nil
+	}
+
+	steps := []struct {
+		name       string
+		after      time.Duration
+		err        error
+		calls      int
+		discovered time.Time
+		failed     bool
+	}{
+		{name: "first discovery", calls: 1, discovered: now},
+		{name: "cached", after: 30 * time.Second, calls: 1, discovered: now},
+		{name: "refresh", after: 30 * time.Second, calls: 2, discovered: now.Add(time.Minute)},
+		{name: "failed refresh serves cached rooms", after: time.Minute, err: errors.New("boom"), calls: 3, discovered: now.Add(time.Minute), failed: true},
+		// only the call that attempted the refresh returns its error
+		{name: "cached after a failed refresh", after: 30 * time.Second, err: errors.New("boom"), calls: 3, discovered: now.Add(time.Minute)},
+		{name: "expired", after: 5 * time.Minute, err: errors.New("boom"), calls: 4, failed: true},
+		// without usable rooms every call retries
+		{name: "retry", err: errors.New("boom"), calls: 5, failed: true},
+		{name: "recovered", calls: 6, discovered: now.Add(7*time.Minute + 30*time.Second)},
+	}
+
+	for _, s := range steps {
+		now = now.Add(s.after)
+		discoverErr = s.err
+
+		rooms, discovered, err := d.get(context.Background(), discover)
+		if calls != s.calls {
+			t.Errorf("%s: got %d discoveries, want %d", s.name, calls, s.calls)
+		}
+		if !discovered.Equal(s.discovered) || (err != nil) != s.failed {
+			t.Errorf("%s: got rooms discovered at %s with error %v", s.name, discovered, err)
+		}
+		if !discovered.IsZero() && len(rooms) != 1 {
+			t.Errorf("%s: got rooms %v", s.name, rooms)
+		}
+	}
+
+	now = now.Add(90 * time.Second)
+	expected := `
+# HELP queue_it_discovered_waiting_rooms Number of waiting rooms found by the last successful discovery.
+# TYPE queue_it_discovered_waiting_rooms gauge
+queue_it_discovered_waiting_rooms 1
+# HELP queue_it_discovery_age_seconds Time since waiting rooms were last discovered successfully.
+# TYPE queue_it_discovery_age_seconds gauge
+queue_it_discovery_age_seconds 90
+# HELP queue_it_discovery_failures_total Number of failed waiting room discoveries.
+# TYPE queue_it_discovery_failures_total counter
+queue_it_discovery_failures_total 3
+`
+	if err := testutil.CollectAndCompare(d, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := (&discoveryConfig{refreshInterval: time.Minute, ttl: time.Second}).newCache(); err == nil {
+		t.Error("expected an error with a ttl shorter than the refresh interval")
+	}
+}
+
+func TestDiscoveryCacheConcurrentGet(t *testing.T) {
+	d, err := (&discoveryConfig{refreshInterval: time.Minute, ttl: 5 * time.Minute}).newCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2022, 3, 1, 10, 0, 0, 0, time.UTC)
+	d.now = func() time.Time { return now }
+
+	rooms := func(ctx context.Context) ([]WaitingRoom, error) {
+		return []WaitingRoom{{EventID: "drop"}}, nil
+	}
+	if _, _, err := d.get(context.Background(), rooms); err != nil {
+		t.Fatal(err)
+	}
+
+	// a slow refresh does not block other polls
+	now = now.Add(2 * time.Minute)
+	started, release := make(chan struct{}), make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		d.get(context.Background(), func(ctx context.Context) ([]WaitingRoom, error) {
+			close(started)
+			<-release
+			return []WaitingRoom{{EventID: "drop"}, {EventID: "sale"}}, nil
+		})
+		close(done)
+	}()
+	<-started
+
+	cached, discovered, err := d.get(context.Background(), func(ctx context.Context) ([]WaitingRoom, error) {
+		t.Error("expected a single refresh at a time")
+		return nil, nil
+	})
+	if err != nil || len(cached) != 1 || !discovered.Equal(now.Add(-2*time.Minute)) {
+		t.Errorf("got rooms %v discovered at %s with error %v during a refresh", cached, discovered, err)
+	}
+	testutil.CollectAndCount(d)
+
+	close(release)
+	<-done
+	if refreshed, _, _ := d.get(context.Background(), rooms); len(refreshed) != 2 {
+		t.Errorf("got rooms %v after the refresh", refreshed)
+	}
+}
+
+func TestDiscoveryCacheExpiredRefresh(t *testing.T) {
+	d, err := (&discoveryConfig{refreshInterval: time.Minute, ttl: 5 * time.Minute}).newCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var calls atomic.Int32
+	started, release := make(chan struct{}), make(chan struct{})
+	discover := func(ctx context.Context) ([]WaitingRoom, error) {
+		if calls.Add(1) == 1 {
+			close(started)
+		}
+		<-release
+		return nil, errors.New("boom")
+	}
+
+	// without usable rooms, polls wait for the refresh in flight and share
+	// its outcome instead of discovering again
+	errs := make(chan error, 3)
+	go func() {
+		_, _, err := d.get(context.Background(), discover)
+		errs <- err
+	}()
+	<-started
+	for n := 0; n < 2; n++ {
+		go func() {
+			_, discovered, err := d.get(context.Background(), discover)
+			if !discovered.IsZero() {
+				t.Errorf("got rooms discovered at %s", discovered)
+			}
+			errs <- err
+		}()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := d.get(ctx, discover); !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v waiting with a cancelled context", err)
+	}
+
+	// let the polls reach the wait before the refresh fails
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	for n := 0; n < 3; n++ {
+		if err := <-errs; err == nil || err.Error() != "boom" {
+			t.Errorf("got error %v, want the refresh error", err)
+		}
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("got %d discoveries, want 1", got)
+	}
+}
+
+func TestPollCachedRooms(t *testing.T) {
+	var searchFails atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/2_0/event/search" && searchFails.Load():
+			w.Write([]byte(`{"ErrorCode": 500, "ErrorText": "Internal error", "HttpStatusCode": 500}`))
+		case r.URL.Path == "/2_0/event/search":
+			w.Write([]byte(`[{"EventId": "drop", "Phase": "queue", "IsTest": "False"}]`))
+		case strings.HasSuffix(r.URL.Path, "/queue/statistics/summary"):
+			w.Write([]byte(`{"TotalQueueCount": "42"}`))
+		default:
+			w.Write([]byte(`{"Entries": [{"Sum": "1"}]}`))
+		}
+	}))
+	defer server.Close()
+
+	q := newQueueitAPI(context.Background(), zap.NewNop(), http.DefaultClient, server.URL, "a-b-c", true)
+	q.discovery, _ = (&discoveryConfig{refreshInterval: time.Nanosecond, ttl: time.Hour}).newCache()
+
+	first := q.poll()
+	if first.err != nil || len(first.rooms) != 1 {
+		t.Fatalf("got poll error %v and %d rooms", first.err, len(first.rooms))
+	}
+
+	searchFails.Store(true)
+	p := q.poll()
+	if p.err != nil || p.discoveryErr == nil || !p.discoveredAt.Equal(first.discoveredAt) {
+		t.Errorf("got poll error %v, discovery error %v and rooms discovered at %s", p.err, p.discoveryErr, p.discoveredAt)
+	}
+	if _, err := p.metrics(); err != nil || len(p.rooms) != 1 {
+		t.Errorf("got %d polled rooms and error %v, want the cached room", len(p.rooms), err)
+	}
+}
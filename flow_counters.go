@@ -0,0 +1,272 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"go.uber.org/zap"
+)
+
+// MAX_FLOW_LOOKBACK bounds how far back statistics details are requested to
+// count the buckets missed since the last poll. Older buckets are caught up
+// from SumOffset
+const MAX_FLOW_LOOKBACK = time.Hour
+
+// flowCounter is a Prometheus counter synthesized from the per-minute sums
+// of a statistics detail
+type flowCounter struct {
+	queueitMetricName  string
+	exportedMetricName string
+	description        string
+}
+
+// flowCounterMetrics are the statistics details exported as counters
+var flowCounterMetrics = []*flowCounter{
+	{queueitMetricName: "queueinflow", exportedMetricName: "queue_it_queue_inflow_total", description: "Users who have joined either the pre-queue or the queue"},
+	{queueitMetricName: "queueoutflow", exportedMetricName: "queue_it_queue_outflow_total", description: "Queue numbers which have been redirected from the queue"},
+	{queueitMetricName: "queueuniqueinflow", exportedMetricName: "queue_it_queue_unique_inflow_total", description: "New (unique) Queue IDs which have entered the queue"},
+	{queueitMetricName: "queueuniqueoutflow", exportedMetricName: "queue_it_queue_unique_outflow_total", description: "Initial queue redirects (first redirect of the queue ID)"},
+	{queueitMetricName: "queueidscanceled", exportedMetricName: "queue_it_queue_ids_canceled_total", description: "Queue IDs which have been canceled by Cancel Action or API"},
+	{queueitMetricName: "safetynetoutflow", exportedMetricName: "queue_it_safety_net_outflow_total", description: "Queue numbers which were redirected without having waited in the queue"},
+	{queueitMetricName: "exceededmaxredirectcount", exportedMetricName: "queue_it_exceeded_max_redirect_total", description: "Visitors who passed through the waiting room more times than they are allowed"},
+}
+
+// definition returns the definition of the counter of a flow statistic
+func (f *flowCounter) definition() *metricDefinition {
+	return roomMetricDefinition(f.exportedMetricName, f.description)
+}
+
+var flowDriftDefinition = &metricDefinition{
+	name:   "queue_it_flow_counter_drift",
+	help:   "Difference between a flow counter and the running total reported by Queue-it, after catching up missed buckets. A positive drift is never corrected as counters do not decrease, the counter overstates the flow by that much.",
+	labels: []string{"waiting_room_id", "statistic"},
+}
+
+// isFlowStatistic reports whether a statistics detail is exported as a counter
+func isFlowStatistic(queueitMetricName string) bool {
+	for _, f := range flowCounterMetrics {
+		if f.queueitMetricName == queueitMetricName {
+			return true
+		}
+	}
+
+	return false
+}
+
+// flowBucket is a completed interval of a statistics detail
+type flowBucket struct {
+	start time.Time
+	end   time.Time
+	sum   float64
+}
+
+// flowDetail is the part of a statistics detail response counted by flow counters
+type flowDetail struct {
+	// start of the first bucket
+	from time.Time
+	// running total of Queue-it before from
+	sumOffset float64
+	// completed buckets, oldest first
+	buckets []*flowBucket
+}
+
+// end returns the time the Queue-it running total of a detail is known at
+func (d *flowDetail) end() time.Time {
+	if len(d.buckets) == 0 {
+		return d.from
+	}
+
+	return d.buckets[len(d.buckets)-1].end
+}
+
+// newFlowDetail returns the buckets of a statistics detail ending no later
+// than to. It returns nil when the response has no start time
+func newFlowDetail(d *StatisticsDetail, to time.Time) *flowDetail {
+	from := parseTimestamp(d.From)
+	if from.IsZero() {
+		return nil
+	}
+
+	interval := time.Duration(d.Interval) * time.Minute
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	flow := &flowDetail{from: from, sumOffset: d.SumOffset, buckets: make([]*flowBucket, 0, len(d.Entries))}
+	for i, e := range d.Entries {
+		start := from.Add(time.Duration(i) * interval)
+		if start.Add(interval).After(to) {
+			break
+		}
+		flow.buckets = append(flow.buckets, &flowBucket{start: start, end: start.Add(interval), sum: e.Sum})
+	}
+
+	return flow
+}
+
+// flowCounters maintains the flow counters of every waiting room. Each
+// completed bucket is added once, and counters are caught up with the
+// running total of Queue-it, SumOffset, when buckets were missed
+type flowCounters struct {
+	logger   *zap.Logger
+	counters map[string]*prometheus.CounterVec
+	drift    *prometheus.GaugeVec
+
+	mu sync.Mutex
+	// end of the last counted bucket by waiting room ID and statistic
+	cursors map[string]map[string]time.Time
+}
+
+// newFlowCounters returns flowCounters that have not counted anything yet
+func newFlowCounters(logger *zap.Logger) *flowCounters {
+	f := &flowCounters{
+		logger:   logger,
+		counters: make(map[string]*prometheus.CounterVec, len(flowCounterMetrics)),
+		drift:    flowDriftDefinition.gaugeVec(),
+		cursors:  make(map[string]map[string]time.Time),
+	}
+
+	for _, m := range flowCounterMetrics {
+		f.counters[m.queueitMetricName] = m.definition().counterVec()
+	}
+
+	return f
+}
+
+// register registers the flow counters to a registerer
+func (f *flowCounters) register(reg prometheus.Registerer) {
+	for _, m := range flowCounterMetrics {
+		reg.MustRegister(f.counters[m.queueitMetricName])
+	}
+	reg.MustRegister(f.drift)
+}
+
+// since returns the start of the statistics details window of a flow
+// statistic: the end of its last counted bucket, or from when it has none
+// or it is older than MAX_FLOW_LOOKBACK
+func (f *flowCounters) since(id string, statistic string, from time.Time, to time.Time) time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	cursor := f.cursors[id][statistic]
+	if cursor.IsZero() || cursor.After(from) || to.Sub(cursor) > MAX_FLOW_LOOKBACK {
+		return from
+	}
+
+	return cursor
+}
+
+// cursorsSnapshot returns a copy of the end of the last counted bucket by
+// waiting room ID and statistic
+func (f *flowCounters) cursorsSnapshot() map[string]map[string]time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	snapshot := make(map[string]map[string]time.Time, len(f.cursors))
+	for id, cursors := range f.cursors {
+		snapshot[id] = make(map[string]time.Time, len(cursors))
+		for statistic, cursor := range cursors {
+			snapshot[id][statistic] = cursor
+		}
+	}
+
+	return snapshot
+}
+
+// restoreCursors resumes counting after persisted cursors, so buckets counted
+// before a restart are not counted again. Later cursors are kept
+func (f *flowCounters) restoreCursors(snapshot map[string]map[string]time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for id, restored := range snapshot {
+		cursors, ok := f.cursors[id]
+		if !ok {
+			cursors = make(map[string]time.Time, len(restored))
+			f.cursors[id] = cursors
+		}
+		for statistic, cursor := range restored {
+			if cursor.After(cursors[statistic]) {
+				cursors[statistic] = cursor
+			}
+		}
+	}
+}
+
+// observe implements pollObserver
+func (f *flowCounters) observe(p *poll) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, r := range p.rooms {
+		for _, m := range r.metrics {
+			if m.err != nil || m.flow == nil {
+				continue
+			}
+			f.count(m)
+		}
+	}
+}
+
+// count adds the buckets of a metric that were not counted yet to its
+// counter, then catches the counter up with the Queue-it running total
+func (f *flowCounters) count(m *queueitMetric) {
+	id := m.waitingRoomID
+	counter := f.counters[m.queueitMetricName].WithLabelValues(id)
+
+	cursors, ok := f.cursors[id]
+	if !ok {
+		cursors = make(map[string]time.Time)
+		f.cursors[id] = cursors
+	}
+	cursor := cursors[m.queueitMetricName]
+
+	total := m.flow.sumOffset
+	for _, b := range m.flow.buckets {
+		total += b.sum
+		if !b.start.Before(cursor) {
+			counter.Add(b.sum)
+			cursor = b.end
+		}
+	}
+
+	// the running total is only known up to the end of the response
+	end := m.flow.end()
+	if end.Before(cursor) {
+		cursors[m.queueitMetricName] = cursor
+		return
+	}
+	cursors[m.queueitMetricName] = end
+
+	drift := counterValue(counter) - total
+	if drift < 0 {
+		f.logger.Info("flowCounters.count(): catching up missed buckets",
+			zap.String("waiting_room_id", id),
+			zap.String("statistic", m.queueitMetricName),
+			zap.Float64("missed", -drift),
+		)
+		counter.Add(-drift)
+		drift = 0
+	} else if drift > 0 {
+		// restarts resume after the last counted bucket, so this means
+		// Queue-it revised past minutes down
+		f.logger.Warn("flowCounters.count(): counter exceeds the Queue-it running total",
+			zap.String("waiting_room_id", id),
+			zap.String("statistic", m.queueitMetricName),
+			zap.Float64("drift", drift),
+		)
+	}
+	f.drift.WithLabelValues(id, m.queueitMetricName).Set(drift)
+}
+
+// counterValue returns the current value of a counter
+func counterValue(c prometheus.Counter) float64 {
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		return 0
+	}
+
+	return m.GetCounter().GetValue()
+}
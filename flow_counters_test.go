@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+func TestNewFlowDetail(t *testing.T) {
+	d := &StatisticsDetail{
+		From:      "2022-03-01T10:00:00Z",
+		Interval:  1,
+		SumOffset: 1000,
+		Entries:   []StatisticsDetailEntry{{Sum: 10}, {Sum: 20}, {Sum: 5}},
+	}
+	to := time.Date(2022, 3, 1, 10, 2, 30, 0, time.UTC)
+
+	flow := newFlowDetail(d, to)
+	// the last minute is still in progress
+	if len(flow.buckets) != 2 || flow.buckets[1].sum != 20 || !flow.end().Equal(time.Date(2022, 3, 1, 10, 2, 0, 0, time.UTC)) {
+		t.Errorf("got buckets %v ending at %s", flow.buckets, flow.end())
+	}
+
+	if i := lastMinuteEntry(d, to); i != 1 {
+		t.Errorf("got last minute entry %d, want 1", i)
+	}
+
+	if newFlowDetail(&StatisticsDetail{}, to) != nil {
+		t.Error("expected no flow detail without a start time")
+	}
+}
+
+func TestFlowCounters(t *testing.T) {
+	f := newFlowCounters(zap.NewNop())
+	minute := func(m int) time.Time { return time.Date(2022, 3, 1, 10, m, 0, 0, time.UTC) }
+
+	observe := func(from int, sumOffset float64, sums ...float64) {
+		flow := &flowDetail{from: minute(from), sumOffset: sumOffset}
+		for i, sum := range sums {
+			flow.buckets = append(flow.buckets, &flowBucket{start: minute(from + i), end: minute(from + i + 1), sum: sum})
+		}
+		f.observe(&poll{rooms: []*roomPoll{{metrics: []*queueitMetric{
+			{queueitMetricName: "queueoutflow", waitingRoomID: "drop", flow: flow},
+			// failed statistics are ignored
+			{queueitMetricName: "queueinflow", waitingRoomID: "drop", flow: flow, err: errors.New("boom")},
+		}}}})
+	}
+	outflow := f.counters["queueoutflow"].WithLabelValues("drop")
+	drift := f.drift.WithLabelValues("drop", "queueoutflow")
+
+	steps := []struct {
+		name    string
+		observe func()
+		want    float64
+		drift   float64
+	}{
+		// the first poll catches up with the running total of Queue-it
+		{name: "first poll", observe: func() { observe(0, 1000, 10) }, want: 1010},
+		// the window starts before the last counted bucket
+		{name: "overlapping window", observe: func() { observe(0, 1000, 10, 20) }, want: 1030},
+		{name: "no completed bucket", observe: func() { observe(2, 1030) }, want: 1030},
+		{name: "missed scrapes", observe: func() { observe(2, 1030, 5, 7) }, want: 1042},
+		// buckets older than the lookback are caught up from SumOffset
+		{name: "gap", observe: func() { observe(10, 1100, 3) }, want: 1103},
+		// counters never decrease
+		{name: "running total lower than the counter", observe: func() { observe(11, 1090, 1) }, want: 1104, drift: 13},
+	}
+
+	for _, s := range steps {
+		s.observe()
+
+		if got := testutil.ToFloat64(outflow); got != s.want {
+			t.Errorf("%s: got counter %v, want %v", s.name, got, s.want)
+		}
+		if got := testutil.ToFloat64(drift); got != s.drift {
+			t.Errorf("%s: got drift %v, want %v", s.name, got, s.drift)
+		}
+	}
+
+	if got := testutil.CollectAndCount(f.counters["queueinflow"]); got != 0 {
+		t.Errorf("got %d inflow series from failed statistics, want 0", got)
+	}
+
+	// the next window starts at the last counted bucket unless it is too old
+	then := minute(13)
+	if got := f.since("drop", "queueoutflow", then, minute(14)); !got.Equal(minute(12)) {
+		t.Errorf("got window start %s, want %s", got, minute(12))
+	}
+	if got := f.since("drop", "queueoutflow", then, minute(12).Add(2*MAX_FLOW_LOOKBACK)); !got.Equal(then) {
+		t.Errorf("got window start %s past the lookback, want %s", got, then)
+	}
+	if got := f.since("other", "queueoutflow", then, minute(14)); !got.Equal(then) {
+		t.Errorf("got window start %s without a counted bucket, want %s", got, then)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+const (
+	OUTCOME_SUCCESS    = "success"
+	OUTCOME_HTTP_ERROR = "http_error"
+	OUTCOME_ERROR      = "error"
+)
+
+// endpointKey is the context key holding the Queue-it endpoint a request targets
+type endpointKey struct{}
+
+// withEndpoint returns a context labelling requests made with it as targeting endpoint
+func withEndpoint(ctx context.Context, endpoint string) context.Context {
+	return context.WithValue(ctx, endpointKey{}, endpoint)
+}
+
+// endpointFromContext returns the Queue-it endpoint set by withEndpoint
+func endpointFromContext(ctx context.Context) string {
+	endpoint, _ := ctx.Value(endpointKey{}).(string)
+	return endpoint
+}
+
+// apiMetrics instruments requests made to the Queue-it API
+type apiMetrics struct {
+	duration     *prometheus.HistogramVec
+	requestSize  *prometheus.HistogramVec
+	responseSize *prometheus.HistogramVec
+	inFlight     *prometheus.GaugeVec
+	requests     *prometheus.CounterVec
+}
+
+var (
+	apiDurationDefinition = &metricDefinition{
+		name:   "queue_it_api_request_duration_seconds",
+		help:   "Duration of Queue-it API requests, until their response body is read.",
+		labels: []string{"endpoint", "code"},
+	}
+	apiRequestSizeDefinition = &metricDefinition{
+		name:   "queue_it_api_request_size_bytes",
+		help:   "Size of Queue-it API request bodies.",
+		labels: []string{"endpoint"},
+	}
+	apiResponseSizeDefinition = &metricDefinition{
+		name:   "queue_it_api_response_size_bytes",
+		help:   "Size of Queue-it API response bodies.",
+		labels: []string{"endpoint"},
+	}
+	apiInFlightDefinition = &metricDefinition{
+		name:   "queue_it_api_requests_in_flight",
+		help:   "Number of Queue-it API requests in flight.",
+		labels: []string{"endpoint"},
+	}
+	apiRequestsDefinition = &metricDefinition{
+		name:   "queue_it_api_requests_total",
+		help:   "Number of Queue-it API requests by status code and outcome. The outcome reflects the HTTP exchange only, Queue-it errors returned with a 200 status count as success.",
+		labels: []string{"endpoint", "code", "outcome"},
+	}
+	apiDefinitions = []*metricDefinition{apiDurationDefinition, apiRequestSizeDefinition, apiResponseSizeDefinition, apiInFlightDefinition, apiRequestsDefinition}
+
+	buildInfoDefinition = &metricDefinition{
+		name: "queue_it_exporter_build_info",
+		help: "A metric with a constant '1' value labeled by the exporter version and the Go version it was built with.",
+	}
+)
+
+// newHistogramVec returns a histogram vector exporting a metric with the given buckets
+func newHistogramVec(d *metricDefinition, buckets []float64) *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: d.name, Help: d.help, Buckets: buckets}, d.labels)
+}
+
+// newAPIMetrics returns unregistered Queue-it API request metrics
+func newAPIMetrics() *apiMetrics {
+	sizeBuckets := prometheus.ExponentialBuckets(64, 4, 8)
+
+	return &apiMetrics{
+		duration:     newHistogramVec(apiDurationDefinition, prometheus.DefBuckets),
+		requestSize:  newHistogramVec(apiRequestSizeDefinition, sizeBuckets),
+		responseSize: newHistogramVec(apiResponseSizeDefinition, sizeBuckets),
+		inFlight:     apiInFlightDefinition.gaugeVec(),
+		requests:     apiRequestsDefinition.counterVec(),
+	}
+}
+
+// register registers the metrics to a registerer
+func (m *apiMetrics) register(reg prometheus.Registerer) {
+	reg.MustRegister(m.duration, m.requestSize, m.responseSize, m.inFlight, m.requests)
+}
+
+// instrument wraps next to record metrics for every request
+func (m *apiMetrics) instrument(next http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		endpoint := endpointFromContext(req.Context())
+		start := time.Now()
+
+		m.inFlight.WithLabelValues(endpoint).Inc()
+		if req.ContentLength >= 0 {
+			m.requestSize.WithLabelValues(endpoint).Observe(float64(req.ContentLength))
+		}
+
+		resp, err := next.RoundTrip(req)
+		if err != nil {
+			m.inFlight.WithLabelValues(endpoint).Dec()
+			m.duration.WithLabelValues(endpoint, "none").Observe(time.Since(start).Seconds())
+			m.requests.WithLabelValues(endpoint, "none", OUTCOME_ERROR).Inc()
+			return nil, err
+		}
+
+		// Queue-it also reports errors in 200 bodies, which are parsed
+		// later by the caller and counted as a success here
+		code := strconv.Itoa(resp.StatusCode)
+		outcome := OUTCOME_SUCCESS
+		if resp.StatusCode >= 400 {
+			outcome = OUTCOME_HTTP_ERROR
+		}
+		m.requests.WithLabelValues(endpoint, code, outcome).Inc()
+
+		// the response is complete once its body is closed
+		resp.Body = &observedBody{ReadCloser: resp.Body, onClose: func(size int64) {
+			m.inFlight.WithLabelValues(endpoint).Dec()
+			m.duration.WithLabelValues(endpoint, code).Observe(time.Since(start).Seconds())
+			m.responseSize.WithLabelValues(endpoint).Observe(float64(size))
+		}}
+
+		return resp, nil
+	})
+}
+
+// roundTripperFunc adapts a function to an http.RoundTripper
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+// RoundTrip implements http.RoundTripper
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// observedBody counts the bytes read from a response body and reports them
+// once, when the body is closed
+type observedBody struct {
+	io.ReadCloser
+	size    int64
+	once    sync.Once
+	onClose func(size int64)
+}
+
+// Read implements io.Reader
+func (b *observedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.size += int64(n)
+	return n, err
+}
+
+// Close implements io.Closer
+func (b *observedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		b.onClose(b.size)
+	})
+	return err
+}
+
+// newBuildInfo returns the exporter's build info gauge
+func newBuildInfo() prometheus.Gauge {
+	buildInfo := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        buildInfoDefinition.name,
+		Help:        buildInfoDefinition.help,
+		ConstLabels: prometheus.Labels{"version": version, "goversion": runtime.Version()},
+	})
+	buildInfo.Set(1)
+
+	return buildInfo
+}
+
+// newRegistry returns a registry with the standard Go, process and build info
+// collectors as well as the exporter's build info
+func newRegistry() *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		collectors.NewBuildInfoCollector(),
+		newBuildInfo(),
+	)
+
+	return reg
+}
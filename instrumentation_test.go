@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestAPIMetricsInstrument(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		w.Write([]byte("0123456789"))
+	}))
+	defer server.Close()
+
+	m := newAPIMetrics()
+	client := &http.Client{Transport: m.instrument(http.DefaultTransport)}
+
+	for _, path := range []string{"/", "/", "/missing"} {
+		req, _ := http.NewRequestWithContext(withEndpoint(context.Background(), "/summary"), "GET", server.URL+path, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	if got := testutil.ToFloat64(m.requests.WithLabelValues("/summary", "200", OUTCOME_SUCCESS)); got != 2 {
+		t.Errorf("got %v successful requests, want 2", got)
+	}
+	if got := testutil.ToFloat64(m.requests.WithLabelValues("/summary", "404", OUTCOME_HTTP_ERROR)); got != 1 {
+		t.Errorf("got %v failed requests, want 1", got)
+	}
+	if got := testutil.ToFloat64(m.inFlight.WithLabelValues("/summary")); got != 0 {
+		t.Errorf("got %v requests in flight, want 0", got)
+	}
+	if got := testutil.CollectAndCount(m.responseSize); got != 1 {
+		t.Errorf("got %d response size series, want 1", got)
+	}
+}
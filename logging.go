@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	LOG_FORMAT_JSON    = "json"
+	LOG_FORMAT_CONSOLE = "console"
+	REDACTED           = "REDACTED"
+)
+
+// redactedHeaders are never logged in clear
+var redactedHeaders = []string{"Api-Key", "Authorization", "Cookie", "Set-Cookie"}
+
+// logConfig holds the logging flags
+type logConfig struct {
+	level       string
+	format      string
+	requests    bool
+	maxBodySize int
+}
+
+// registerFlags adds the logging flags to a flag set
+func (c *logConfig) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.level, "log.level", "info", "Only log messages with the given severity or above. One of: debug, info, warn, error")
+	fs.StringVar(&c.format, "log.format", LOG_FORMAT_JSON, "Output format of log messages. One of: json, console")
+	fs.BoolVar(&c.requests, "log.requests", false, "Log every Queue-it API request at debug level, with the Api-Key header redacted")
+	fs.IntVar(&c.maxBodySize, "log.max-body-size", 512, "Maximum number of response body bytes included in request logs")
+}
+
+// newLogger returns a logger honoring the logging flags
+func (c *logConfig) newLogger() (*zap.Logger, error) {
+	level, err := zapcore.ParseLevel(c.level)
+	if err != nil {
+		return nil, fmt.Errorf("invalid log.level: %w", err)
+	}
+
+	return c.build(level)
+}
+
+// newAuditLogger returns a logger honoring log.format but not log.level, so
+// audit records are never filtered out
+func (c *logConfig) newAuditLogger() (*zap.Logger, error) {
+	return c.build(zapcore.DebugLevel)
+}
+
+// build returns a logger with the given minimum level in the log.format format
+func (c *logConfig) build(level zapcore.Level) (*zap.Logger, error) {
+	cfg := zap.NewProductionConfig()
+	cfg.Level = zap.NewAtomicLevelAt(level)
+
+	switch c.format {
+	case LOG_FORMAT_JSON:
+	case LOG_FORMAT_CONSOLE:
+		cfg.Encoding = LOG_FORMAT_CONSOLE
+		cfg.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+		cfg.EncoderConfig.EncodeLevel = zapcore.CapitalLevelEncoder
+	default:
+		return nil, fmt.Errorf("invalid log.format %q, must be one of json or console", c.format)
+	}
+
+	return cfg.Build()
+}
+
+// wrapTransport logs requests sent through next when request logs are enabled
+func (c *logConfig) wrapTransport(logger *zap.Logger, next http.RoundTripper) http.RoundTripper {
+	if !c.requests {
+		return next
+	}
+
+	return logRequests(logger, c.maxBodySize, next)
+}
+
+// redactHeaders returns a loggable copy of headers with secrets redacted
+func redactHeaders(headers http.Header) map[string]string {
+	result := make(map[string]string, len(headers))
+	for name, values := range headers {
+		if len(values) > 0 {
+			result[name] = values[0]
+		}
+	}
+
+	for _, name := range redactedHeaders {
+		if _, ok := result[name]; ok {
+			result[name] = REDACTED
+		}
+	}
+
+	return result
+}
+
+// logRequests wraps next to log every request at debug level once its response
+// body is closed. At most maxBodySize bytes of the response body are logged
+func logRequests(logger *zap.Logger, maxBodySize int, next http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		start := time.Now()
+		fields := []zap.Field{
+			zap.String("method", req.Method),
+			zap.String("path", req.URL.Path),
+			zap.String("endpoint", endpointFromContext(req.Context())),
+			zap.Any("headers", redactHeaders(req.Header)),
+		}
+
+		resp, err := next.RoundTrip(req)
+		if err != nil {
+			logger.Debug("queue-it api request failed", append(fields, zap.Duration("latency", time.Since(start)), zap.Error(err))...)
+			return nil, err
+		}
+
+		resp.Body = &loggedBody{ReadCloser: resp.Body, max: maxBodySize, onClose: func(size int64, body []byte) {
+			logger.Debug("queue-it api request", append(fields,
+				zap.Int("status", resp.StatusCode),
+				zap.Duration("latency", time.Since(start)),
+				zap.Int64("bodySize", size),
+				zap.ByteString("body", body),
+			)...)
+		}}
+
+		return resp, nil
+	})
+}
+
+// loggedBody keeps the first max bytes read from a response body and reports
+// them once, when the body is closed
+type loggedBody struct {
+	io.ReadCloser
+	max     int
+	size    int64
+	head    bytes.Buffer
+	once    sync.Once
+	onClose func(size int64, body []byte)
+}
+
+// Read implements io.Reader
+func (b *loggedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.size += int64(n)
+
+	if room := b.max - b.head.Len(); room > 0 {
+		if room > n {
+			room = n
+		}
+		b.head.Write(p[:room])
+	}
+
+	return n, err
+}
+
+// Close implements io.Closer
+func (b *loggedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		b.onClose(b.size, b.head.Bytes())
+	})
+	return err
+}
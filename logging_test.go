@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestLogRequestsRedactsAndTrims(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("0123456789"))
+	}))
+	defer server.Close()
+
+	core, logs := observer.New(zapcore.DebugLevel)
+	q := newQueueitAPI(context.Background(), zap.New(core), &http.Client{Transport: logRequests(zap.New(core), 4, http.DefaultTransport)}, server.URL, "a-b-c", true)
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	q.addHeaders(req)
+	resp, err := q.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	entries := logs.All()
+	if len(entries) != 1 {
+		t.Fatalf("got %d log entries, want 1", len(entries))
+	}
+
+	fields := entries[0].ContextMap()
+	if strings.Contains(fmt.Sprint(fields), "a-b-c") {
+		t.Error("api key was logged")
+	}
+	if headers := fields["headers"].(map[string]string); headers["Api-Key"] != REDACTED {
+		t.Errorf("Api-Key header was not redacted: %v", headers)
+	}
+	if fields["body"] != "0123" || fields["bodySize"] != int64(10) {
+		t.Errorf("body was not trimmed: %v", fields)
+	}
+}
+
+func TestAuditLoggerIgnoresLevel(t *testing.T) {
+	cfg := &logConfig{level: "error", format: LOG_FORMAT_JSON}
+
+	logger, err := cfg.newLogger()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if logger.Core().Enabled(zap.InfoLevel) {
+		t.Error("logger logs info messages with log.level=error")
+	}
+
+	audit, err := cfg.newAuditLogger()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !audit.Core().Enabled(zap.InfoLevel) {
+		t.Error("audit logger drops info messages with log.level=error")
+	}
+}
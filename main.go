@@ -1,51 +1,49 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"flag"
-	"html/template"
-	"log"
+	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
 )
 
-type paths struct {
-	Metrics template.URL
-	Healthz template.URL
+// queueitConfig holds the flags required to build a queueitAPI
+type queueitConfig struct {
+	baseURL              string
+	apiKeyPath           string
+	omitTestWaitingRooms bool
+	fetchRoomConfig      bool
+	flowCounters         bool
 }
 
-func main() {
-	var listenAddress string
-	var metricsPath string
-	var healthzPath string
-	var queueitBaseURL string
-	var queueitAPIKeyPath string
-	var omitTestWaitingRooms bool
-	var apiKey string
-
-	logger, _ := zap.NewProduction()
-	defer logger.Sync()
+// registerFlags adds the Queue-it API flags to a flag set
+func (c *queueitConfig) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.baseURL, "config.queue-it-base-url", "", "Base URL to your Queue-it api")
+	fs.StringVar(&c.apiKeyPath, "config.queue-it-api-key-path", "", "Absolute path to Queue-it API Key file")
+	fs.BoolVar(&c.omitTestWaitingRooms, "config.omit-test-waiting-rooms", true, "Whether to filter out test waiting rooms metrics")
+	fs.BoolVar(&c.fetchRoomConfig, "config.fetch-waiting-room-config", false, "Whether to fetch and export the configuration of every polled waiting room, one more Queue-it request per room and poll")
+	fs.BoolVar(&c.flowCounters, "config.flow-counters", true, "Whether to export flow statistics as counters summing every completed minute")
+}
 
-	flag.StringVar(&listenAddress, "web.listen-address", ":8000", "Address on which to expose metrics and web interface.")
-	flag.StringVar(&metricsPath, "web.telemetry-path", "/metrics", "Path under which to expose metrics.")
-	flag.StringVar(&healthzPath, "web.healthcheck-path", "/healthz", "Path under which to run healthchecks")
-	flag.StringVar(&queueitBaseURL, "config.queue-it-base-url", "", "Base URL to your Queue-it api")
-	flag.StringVar(&queueitAPIKeyPath, "config.queue-it-api-key-path", "", "Absolute path to Queue-it API Key file")
-	flag.BoolVar(&omitTestWaitingRooms, "config.omit-test-waiting-rooms", true, "Whether to filter out test waiting rooms metrics")
-	flag.Parse()
+// newAPI validates the configuration and returns a queueitAPI sending requests with client
+func (c *queueitConfig) newAPI(ctx context.Context, logger *zap.Logger, client *http.Client) (*queueitAPI, error) {
+	var apiKey string
 
-	if queueitBaseURL == "" {
-		panic("please provide a Queue-it API endpoint as config.queue-it-base-url")
+	if c.baseURL == "" {
+		return nil, errors.New("please provide a Queue-it API endpoint as config.queue-it-base-url")
 	}
 
-	if queueitAPIKeyPath != "" {
-		content, err := os.ReadFile(queueitAPIKeyPath)
+	if c.apiKeyPath != "" {
+		content, err := os.ReadFile(c.apiKeyPath)
 		if err != nil {
-			panic("cannot read file from config.queue-it-api-key-path: " + queueitAPIKeyPath)
+			return nil, errors.New("cannot read file from config.queue-it-api-key-path: " + c.apiKeyPath)
 		}
 
 		apiKey = string(content)
@@ -55,61 +53,242 @@ func main() {
 
 	// Can't do anything without an API key
 	if apiKey == "" {
-		panic("please provide a Queue-it API key as the environment variable QUEUEIT_API_KEY or a mounted file with its path set to -config.queue-it-api-key-path")
+		return nil, errors.New("please provide a Queue-it API key as the environment variable QUEUEIT_API_KEY or a mounted file with its path set to -config.queue-it-api-key-path")
 	}
 
-	c := newCollector(
+	api := newQueueitAPI(
+		ctx,
 		logger,
-		newQueueitAPI(
-			logger,
-			queueitBaseURL,
-			apiKey,
-			omitTestWaitingRooms,
-		),
+		client,
+		c.baseURL,
+		apiKey,
+		c.omitTestWaitingRooms,
 	)
+	api.fetchRoomConfig = c.fetchRoomConfig
 
-	// Register collector
-	prometheus.MustRegister(c)
-
-	tmpl, err := template.New("index").
-		Parse(`<html>
-					<head><title>Kube Metrics Server</title></head>
-					<body>
-					<h1>Kube Metrics</h1>
-				<ul>
-					<li><a href='{{.Metrics}}'>metrics</a></li>
-					<li><a href='{{.Healthz}}'>healthz</a></li>
-				</ul>
-					</body>
-					</html>`)
+	return api, nil
+}
+
+func main() {
+	// Dispatch to a subcommand if one was provided, otherwise run the exporter
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			os.Exit(cmd.run(os.Args[2:]))
+		}
+	}
+
+	var serverCfg serverConfig
+	var queueitCfg queueitConfig
+	var logCfg logConfig
+	var tracingCfg tracingConfig
+	var otlpMetricsCfg otlpMetricsConfig
+	var webhookCfg webhookConfig
+	var adminCfg adminConfig
+	var controllerCfg controllerConfig
+	var stateCfg stateConfig
+	var discoveryCfg discoveryConfig
+	var pollingCfg pollingConfig
+
+	serverCfg.registerFlags(flag.CommandLine)
+	queueitCfg.registerFlags(flag.CommandLine)
+	logCfg.registerFlags(flag.CommandLine)
+	tracingCfg.registerFlags(flag.CommandLine)
+	otlpMetricsCfg.registerFlags(flag.CommandLine)
+	webhookCfg.registerFlags(flag.CommandLine)
+	adminCfg.registerFlags(flag.CommandLine)
+	controllerCfg.registerFlags(flag.CommandLine)
+	stateCfg.registerFlags(flag.CommandLine)
+	discoveryCfg.registerFlags(flag.CommandLine)
+	pollingCfg.registerFlags(flag.CommandLine)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [command] [flags]\n\nCommands:\n", os.Args[0])
+		printCommands(flag.CommandLine.Output())
+		fmt.Fprintf(flag.CommandLine.Output(), "\nRun without a command to start the exporter. Flags:\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	logger, err := logCfg.newLogger()
 	if err != nil {
-		log.Fatal("failed to parse index template")
+		panic(err.Error())
 	}
+	defer logger.Sync()
+
+	// ctx is done on SIGTERM or SIGINT
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
 
-	out := &bytes.Buffer{}
-	err = tmpl.Execute(out, &paths{
-		Metrics: template.URL(metricsPath),
-		Healthz: template.URL(healthzPath),
-	})
+	// Queue-it requests outlive ctx so in-flight scrapes can be drained; they
+	// are aborted once the server is shut down
+	pollCtx, stopPolling := context.WithCancel(context.Background())
+	defer stopPolling()
+
+	tracerProvider, err := tracingCfg.newTracerProvider(ctx)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	registry := newRegistry()
+
+	// Instrument requests to the Queue-it API
+	apiMetrics := newAPIMetrics()
+	apiMetrics.register(registry)
+	client := &http.Client{Transport: traceRequests(apiMetrics.instrument(logCfg.wrapTransport(logger, http.DefaultTransport)))}
+
+	api, err := queueitCfg.newAPI(pollCtx, logger, client)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	// Discover waiting rooms on their own interval
+	discovery, err := discoveryCfg.newCache()
 	if err != nil {
-		log.Fatal("failed to execute index template")
+		panic(err.Error())
+	}
+	if discovery != nil {
+		registry.MustRegister(discovery)
+		api.discovery = discovery
 	}
 
-	// Add root path
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write(out.Bytes())
-	})
+	// Optionally poll waiting rooms on per-phase intervals
+	if schedule := pollingCfg.newSchedule(); schedule != nil {
+		registry.MustRegister(schedule)
+		api.schedule = schedule
+	}
 
-	// Add healthzPath
-	http.HandleFunc(healthzPath, func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(http.StatusText(http.StatusOK)))
-	})
+	status := newExporterStatus()
+	observers := make([]pollObserver, 0)
 
-	// Handle metrics requests
-	http.Handle(metricsPath, promhttp.Handler())
+	// Optionally persist the exporter state across restarts
+	store := stateCfg.newStore(logger, status)
+	if store != nil {
+		store.track("queue_it_api_requests_total", apiMetrics.requests)
+	}
+
+	// Sum flow statistics into counters
+	if queueitCfg.flowCounters {
+		flows := newFlowCounters(logger)
+		flows.register(registry)
+		api.flowCounters = flows
+		observers = append(observers, flows)
+		if store != nil {
+			for _, m := range flowCounterMetrics {
+				store.track(m.exportedMetricName, flows.counters[m.queueitMetricName])
+			}
+			store.trackFlows(flows)
+		}
+	}
+
+	// Count waiting room configuration changes
+	if queueitCfg.fetchRoomConfig {
+		drift := newConfigDrift(logger)
+		drift.register(registry)
+		observers = append(observers, drift)
+		if store != nil {
+			store.track("queue_it_waiting_room_config_changes_total", drift.changes)
+		}
+	}
+
+	// Optionally notify webhooks of waiting room lifecycle events
+	notifier, err := webhookCfg.newNotifier(pollCtx, logger)
+	if err != nil {
+		panic(err.Error())
+	}
+	if notifier != nil {
+		notifier.register(registry)
+		observers = append(observers, notifier)
+		if store != nil {
+			store.track("queue_it_webhook_deliveries_total", notifier.deliveries)
+		}
+	}
+
+	// Optionally adjust the max outflow of a waiting room to backend health
+	controller, err := controllerCfg.newController(logger, api)
+	if err != nil {
+		panic(err.Error())
+	}
+	if controller != nil {
+		controller.register(registry)
+		if store != nil {
+			store.track("queue_it_controller_decisions_total", controller.decisions)
+		}
+		go controller.run(ctx)
+	}
+
+	// Restore the previous state once every counter is tracked, observers
+	// see the restored poll as the previous one
+	if store != nil {
+		restored, err := store.restore()
+		if err != nil {
+			panic(err.Error())
+		}
+		if restored != nil {
+			for _, o := range observers {
+				o.observe(restored)
+			}
+		}
+		observers = append(observers, store)
+	}
+
+	c := newCollector(logger, api, status, observers...)
+
+	// Register collector, scrapes poll Queue-it
+	scrapes := prometheus.NewRegistry()
+	scrapes.MustRegister(c)
+
+	// Optionally push the registry over OTLP alongside serving it, pushes
+	// export the last poll of a scrape when there is a recent one
+	pushes := prometheus.NewRegistry()
+	pushes.MustRegister(c.latest(otlpMetricsCfg.interval))
+	meterProvider, err := otlpMetricsCfg.newMeterProvider(ctx, prometheus.Gatherers{registry, pushes}, queueitCfg.baseURL)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	handler := newHandler(&serverCfg, flag.CommandLine, prometheus.Gatherers{registry, scrapes}, status)
+	auditLogger, err := logCfg.newAuditLogger()
+	if err != nil {
+		panic(err.Error())
+	}
+	defer auditLogger.Sync()
+	if err := adminCfg.register(handler, auditLogger, api); err != nil {
+		panic(err.Error())
+	}
+
+	// every shutdown stage shares a single web.shutdown-timeout deadline
+	shutdownCtx, cancelShutdown := serverCfg.shutdownContext(ctx)
+	defer cancelShutdown()
+
+	err = serve(ctx, shutdownCtx, logger, newServer(&serverCfg, handler), &serverCfg)
+	// start the deadline when the server failed on its own
+	stop()
+
+	// push the last metrics before aborting Queue-it requests
+	if meterProvider != nil {
+		if err := meterProvider.Shutdown(shutdownCtx); err != nil {
+			logger.Warn("failed to push metrics", zap.Error(err))
+		}
+	}
+	stopPolling()
+
+	// save counters updated since the last poll
+	if store != nil {
+		if err := store.flush(); err != nil {
+			logger.Warn("failed to save state", zap.Error(err))
+		}
+	}
+
+	// flush spans of the last polls
+	if tracerProvider != nil {
+		if err := tracerProvider.Shutdown(shutdownCtx); err != nil {
+			logger.Warn("failed to flush traces", zap.Error(err))
+		}
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error("queue-it exporter did not shut down cleanly", zap.Error(err))
+		logger.Sync()
+		os.Exit(1)
+	}
 
-	// Listen
-	logger.Info("queue-it exporter is listening", zap.String("address", listenAddress))
-	log.Fatal(http.ListenAndServe(listenAddress, nil))
+	logger.Info("queue-it exporter stopped")
 }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	prometheusbridge "go.opentelemetry.io/contrib/bridges/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// Resource attributes
+const (
+	ATTRIBUTE_ACCOUNT  = attribute.Key("queue_it.account")
+	ATTRIBUTE_BASE_URL = attribute.Key("queue_it.base_url")
+)
+
+// otlpMetricsConfig holds the OTLP metrics push flags
+type otlpMetricsConfig struct {
+	endpoint string
+	protocol string
+	insecure bool
+	interval time.Duration
+	account  string
+}
+
+// registerFlags adds the OTLP metrics push flags to a flag set
+func (c *otlpMetricsConfig) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.endpoint, "metrics.otlp-endpoint", "", "host:port of an OTLP receiver to push metrics to. Pushing is disabled when empty")
+	fs.StringVar(&c.protocol, "metrics.otlp-protocol", OTLP_PROTOCOL_GRPC, "OTLP protocol used to push metrics. One of: grpc, http")
+	fs.BoolVar(&c.insecure, "metrics.otlp-insecure", false, "Disable TLS when pushing metrics")
+	fs.DurationVar(&c.interval, "metrics.otlp-interval", time.Minute, "Interval between two pushes over OTLP. Pushes export the last poll, and only poll Queue-it when it is older than this")
+	fs.StringVar(&c.account, "metrics.otlp-account", "", "Queue-it account set as the queue_it.account resource attribute. Defaults to the first label of the config.queue-it-base-url host")
+}
+
+// accountFromBaseURL returns the Queue-it account of an API base URL such as
+// https://account.api2.queue-it.net
+func accountFromBaseURL(baseURL string) string {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return ""
+	}
+
+	account, _, _ := strings.Cut(u.Hostname(), ".")
+	return account
+}
+
+// newMeterProvider returns a meter provider pushing every metric gathered from
+// gatherer over OTLP on each interval. It returns a nil provider when pushing
+// is disabled
+func (c *otlpMetricsConfig) newMeterProvider(ctx context.Context, gatherer prometheus.Gatherer, baseURL string) (*sdkmetric.MeterProvider, error) {
+	if c.endpoint == "" {
+		return nil, nil
+	}
+
+	var exporter sdkmetric.Exporter
+	var err error
+	switch c.protocol {
+	case OTLP_PROTOCOL_GRPC:
+		opts := []otlpmetricgrpc.Option{otlpmetricgrpc.WithEndpoint(c.endpoint)}
+		if c.insecure {
+			opts = append(opts, otlpmetricgrpc.WithInsecure())
+		}
+		exporter, err = otlpmetricgrpc.New(ctx, opts...)
+	case OTLP_PROTOCOL_HTTP:
+		opts := []otlpmetrichttp.Option{otlpmetrichttp.WithEndpoint(c.endpoint)}
+		if c.insecure {
+			opts = append(opts, otlpmetrichttp.WithInsecure())
+		}
+		exporter, err = otlpmetrichttp.New(ctx, opts...)
+	default:
+		return nil, fmt.Errorf("invalid metrics.otlp-protocol %q, must be one of grpc or http", c.protocol)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP metric exporter: %w", err)
+	}
+
+	account := c.account
+	if account == "" {
+		account = accountFromBaseURL(baseURL)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(SERVICE_NAME),
+		semconv.ServiceVersion(version),
+		ATTRIBUTE_ACCOUNT.String(account),
+		ATTRIBUTE_BASE_URL.String(baseURL),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	// every collection of the reader gathers gatherer
+	reader := sdkmetric.NewPeriodicReader(exporter,
+		sdkmetric.WithInterval(c.interval),
+		sdkmetric.WithProducer(prometheusbridge.NewMetricProducer(prometheusbridge.WithGatherer(gatherer))),
+	)
+
+	return sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader), sdkmetric.WithResource(res)), nil
+}
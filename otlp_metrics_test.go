@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	collectormetrics "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestAccountFromBaseURL(t *testing.T) {
+	type test struct {
+		baseURL string
+		want    string
+	}
+
+	tests := []test{
+		{baseURL: "https://dapper.api2.queue-it.net", want: "dapper"},
+		{baseURL: "https://dapper.api2.queue-it.net/", want: "dapper"},
+		{baseURL: "localhost:8080", want: ""},
+	}
+
+	for _, tc := range tests {
+		if got := accountFromBaseURL(tc.baseURL); got != tc.want {
+			t.Errorf("accountFromBaseURL(%q) = %q, want %q", tc.baseURL, got, tc.want)
+		}
+	}
+}
+
+func TestMeterProviderPushesRegistry(t *testing.T) {
+	requests := make(chan *collectormetrics.ExportMetricsServiceRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		req := &collectormetrics.ExportMetricsServiceRequest{}
+		if err := proto.Unmarshal(body, req); err != nil {
+			t.Error(err)
+		}
+		requests <- req
+	}))
+	defer server.Close()
+
+	reg := prometheus.NewRegistry()
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "queue_it_total_queue_count", Help: "help"}, []string{"waiting_room_id"})
+	gauge.WithLabelValues("room1").Set(42)
+	reg.MustRegister(gauge)
+
+	cfg := &otlpMetricsConfig{
+		endpoint: strings.TrimPrefix(server.URL, "http://"),
+		protocol: OTLP_PROTOCOL_HTTP,
+		insecure: true,
+		interval: time.Hour,
+	}
+	mp, err := cfg.newMeterProvider(context.Background(), reg, "https://dapper.api2.queue-it.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mp.ForceFlush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer mp.Shutdown(context.Background())
+
+	req := <-requests
+	rm := req.ResourceMetrics[0]
+
+	var account string
+	for _, attr := range rm.Resource.Attributes {
+		if attr.Key == string(ATTRIBUTE_ACCOUNT) {
+			account = attr.Value.GetStringValue()
+		}
+	}
+	if account != "dapper" {
+		t.Errorf("got account %q, want dapper", account)
+	}
+
+	var found bool
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != "queue_it_total_queue_count" {
+				continue
+			}
+			point := m.GetGauge().DataPoints[0]
+			if point.GetAsDouble() != 42 || point.Attributes[0].Value.GetStringValue() != "room1" {
+				t.Errorf("got data point %v", point)
+			}
+			found = true
+		}
+	}
+	if !found {
+		t.Error("queue_it_total_queue_count was not pushed")
+	}
+}
+
+func TestLatestPollCollector(t *testing.T) {
+	var searches int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/2_0/event/search":
+			searches++
+			w.Write([]byte(`[{"EventId": "drop", "Phase": "queue", "IsTest": "False"}]`))
+		case strings.HasSuffix(r.URL.Path, "/queue/statistics/summary"):
+			w.Write([]byte(`{"TotalQueueCount": "42"}`))
+		default:
+			w.Write([]byte(`{"Entries": [{"Sum": "1"}]}`))
+		}
+	}))
+	defer server.Close()
+
+	api := newQueueitAPI(context.Background(), zap.NewNop(), http.DefaultClient, server.URL, "a-b-c", true)
+	api.fetchRoomConfig = false
+	c := newCollector(zap.NewNop(), api, newExporterStatus())
+
+	// without any poll yet a push polls
+	pushed := testutil.CollectAndCount(c.latest(time.Hour))
+	if searches != 1 {
+		t.Fatalf("got %d discoveries, want 1", searches)
+	}
+
+	// a recent poll is pushed as is
+	if got := testutil.CollectAndCount(c.latest(time.Hour)); got != pushed || searches != 1 {
+		t.Errorf("got %d metrics and %d discoveries, want %d metrics and 1 discovery", got, searches, pushed)
+	}
+
+	// an old one is not
+	testutil.CollectAndCount(c.latest(0))
+	if searches != 2 {
+		t.Errorf("got %d discoveries, want 2", searches)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// staticCollector collects a fixed set of metrics
+type staticCollector []prometheus.Metric
+
+// Describe implements Collector
+func (c staticCollector) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(c, ch)
+}
+
+// Collect implements Collector
+func (c staticCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, m := range c {
+		ch <- m
+	}
+}
+
+// pushPoll pushes the outcome of a poll to a Pushgateway. queue_it_up and the
+// poll duration are pushed to a group per account, the statistics of each
+// waiting room to a group per account and waiting room. Failed statistics are
+// not pushed, pushPoll returns the poll error in that case
+func pushPoll(client *http.Client, gateway string, job string, account string, p *poll) error {
+	_, pollErr := p.metrics()
+
+	upValue := 1.0
+	if pollErr != nil {
+		upValue = 0
+	}
+
+	err := push.New(gateway, job).
+		Client(client).
+		Grouping("account", account).
+		Collector(staticCollector{
+			prometheus.MustNewConstMetric(up, prometheus.GaugeValue, upValue),
+			prometheus.MustNewConstMetric(duration, prometheus.GaugeValue, p.duration.Seconds()),
+		}).
+		Push()
+	if err != nil {
+		return fmt.Errorf("failed to push to %s: %w", gateway, err)
+	}
+
+	for _, r := range p.rooms {
+		metrics := make(staticCollector, 0, len(r.metrics))
+		for _, m := range r.metrics {
+			// the Pushgateway adds the waiting_room_id grouping label back
+			if m.err == nil {
+				metrics = append(metrics, prometheus.MustNewConstMetric(
+					prometheus.NewDesc(m.exportedMetricName, m.description, nil, nil),
+					prometheus.GaugeValue,
+					m.value,
+				))
+			}
+		}
+
+		err := push.New(gateway, job).
+			Client(client).
+			Grouping("account", account).
+			Grouping("waiting_room_id", r.room.EventID).
+			Collector(metrics).
+			Push()
+		if err != nil {
+			return fmt.Errorf("failed to push waiting room %s to %s: %w", r.room.EventID, gateway, err)
+		}
+	}
+
+	return pollErr
+}
+
+// runPush polls every waiting room once and pushes the outcome to a
+// Pushgateway. It exits non-zero when the poll or a push failed
+func runPush(args []string) int {
+	var cfg commandConfig
+	var gateway, job, account string
+	var timeout time.Duration
+
+	fs := newCommandFlagSet("push", &cfg)
+	fs.StringVar(&gateway, "gateway", "", "URL of the Pushgateway to push to, e.g. http://pushgateway:9091")
+	fs.StringVar(&job, "job", SERVICE_NAME, "Job the metrics are pushed under")
+	fs.StringVar(&account, "account", "", "Queue-it account grouping label. Defaults to the first label of the config.queue-it-base-url host")
+	fs.DurationVar(&timeout, "timeout", 30*time.Second, "Timeout of a single push request")
+	fs.Parse(args)
+
+	if gateway == "" {
+		return exitCode(errors.New("please provide a Pushgateway URL as -gateway"))
+	}
+
+	if account == "" {
+		account = accountFromBaseURL(cfg.queueit.baseURL)
+	}
+
+	cc, err := newCommandContext(&cfg)
+	if err != nil {
+		return exitCode(err)
+	}
+	defer cc.logger.Sync()
+
+	p := cc.api.poll()
+	if err := pushPoll(&http.Client{Timeout: timeout}, gateway, job, account, p); err != nil {
+		return exitCode(err)
+	}
+
+	fmt.Fprintf(cc.stdout, "ok: pushed %d waiting rooms\n", len(p.rooms))
+
+	return 0
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPushPoll(t *testing.T) {
+	var mu sync.Mutex
+	pushed := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			t.Errorf("got method %s, want PUT", r.Method)
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		pushed[r.URL.Path] = string(body)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	p := &poll{discovered: true, rooms: []*roomPoll{{
+		room: WaitingRoom{EventID: "room1"},
+		metrics: []*queueitMetric{
+			{exportedMetricName: "queue_it_total_queue_count", waitingRoomID: "room1", value: 42},
+			{exportedMetricName: "queue_it_queue_inflow_count", waitingRoomID: "room1", err: errors.New("bad gateway")},
+		},
+	}}}
+
+	if err := pushPoll(http.DefaultClient, server.URL, "job", "dapper", p); err == nil {
+		t.Error("expected the failed statistic to be reported")
+	}
+
+	// grouping labels are not ordered in push paths
+	var room string
+	for path, body := range pushed {
+		if strings.Contains(path, "/waiting_room_id/room1") && strings.Contains(path, "/account/dapper") {
+			room = body
+		}
+	}
+
+	account, ok := pushed["/metrics/job/job/account/dapper"]
+	if !ok || !strings.Contains(account, "queue_it_up") {
+		t.Errorf("queue_it_up was not pushed to the account group: %v", pushed)
+	}
+
+	if !strings.Contains(room, "queue_it_total_queue_count") {
+		t.Errorf("waiting room metrics were not pushed to the room group: %v", pushed)
+	}
+	if strings.Contains(room, "queue_it_queue_inflow_count") {
+		t.Error("failed statistic was pushed")
+	}
+}
+
+func TestPushPollTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	// a hanging Pushgateway fails the push instead of blocking it
+	client := &http.Client{Timeout: 50 * time.Millisecond}
+	if err := pushPoll(client, server.URL, "job", "dapper", &poll{discovered: true}); err == nil {
+		t.Error("expected the push to time out")
+	}
+}
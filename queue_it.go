@@ -1,14 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
@@ -23,25 +29,28 @@ const (
 	TOTAL_METRIC_COUNT               = SUMMARY_METRIC_COUNT + DETAILS_METRIC_COUNT + ACCUMULATED_DETAILS_METRIC_COUNT
 )
 
-// newQueueitAPI creates a queueitAPI
-func newQueueitAPI(logger *zap.Logger, baseURL string, apiKey string, omitTestWaitingRooms bool) *queueitAPI {
+// newQueueitAPI creates a queueitAPI sending requests with client. Requests in flight are aborted once ctx is done
+func newQueueitAPI(ctx context.Context, logger *zap.Logger, client *http.Client, baseURL string, apiKey string, omitTestWaitingRooms bool) *queueitAPI {
 	return &queueitAPI{
+		ctx:                  ctx,
 		logger:               logger,
+		client:               client,
 		apiKey:               apiKey,
 		baseUrl:              baseURL,
 		omitTestWaitingRooms: omitTestWaitingRooms,
 	}
 }
 
-// doRequest executes an HTTP request and returns the body and error
-func (q *queueitAPI) doRequest(method string, path string, body io.Reader) ([]byte, error) {
-	req, err := http.NewRequest(method, fmt.Sprintf("%s%s", q.baseUrl, path), body)
+// doRequest executes an HTTP request and returns the body and error.
+// endpoint identifies the called Queue-it endpoint in instrumentation
+func (q *queueitAPI) doRequest(ctx context.Context, endpoint string, method string, path string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequestWithContext(withEndpoint(ctx, endpoint), method, fmt.Sprintf("%s%s", q.baseUrl, path), body)
 	if err != nil {
 		return nil, err
 	}
 	q.addHeaders(req)
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := q.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -66,10 +75,10 @@ func (q *queueitAPI) addHeaders(req *http.Request) {
 func (q *queueitAPI) handleAPIError(body []byte, incomingError error) error {
 	var apiError APIError
 	err := json.Unmarshal(body, &apiError)
-	// if body fails to unmarshal to an apiError object log everything and
-	// return unmarshal error
+	// if body fails to unmarshal to an apiError object log the failure and
+	// return unmarshal error, bodies are only logged by request logs
 	if err != nil {
-		q.logger.Info("unknown queue-it api error", zap.Error(err), zap.String("body", string(body)))
+		q.logger.Info("unknown queue-it api error", zap.Error(err), zap.Int("bodySize", len(body)))
 		return err
 	}
 
@@ -91,13 +100,22 @@ func (q *queueitAPI) dropTestWaitingRooms(waitingRooms []WaitingRoom) []WaitingR
 	return result
 }
 
-// getOpenWaitingRooms returns waiting ongoing waiting rooms
-func (q *queueitAPI) getOpenWaitingRooms() ([]WaitingRoom, error) {
+// getOpenWaitingRooms returns waiting ongoing waiting rooms, and upcoming
+// ones with event windows
+func (q *queueitAPI) getOpenWaitingRooms(ctx context.Context) ([]WaitingRoom, error) {
+	ctx, span := tracer.Start(ctx, "discover waiting rooms")
+	defer span.End()
+
+	phases := "prequeue, queue"
+	if q.schedule != nil {
+		phases = q.schedule.searchedPhases()
+	}
+
 	input := []map[string]string{
 		{
 			"Name":     "Phase",
 			"Operator": "in",
-			"Value":    "prequeue, queue",
+			"Value":    phases,
 		},
 	}
 
@@ -106,7 +124,7 @@ func (q *queueitAPI) getOpenWaitingRooms() ([]WaitingRoom, error) {
 		return nil, err
 	}
 
-	body, err := q.doRequest("POST", "/2_0/event/search", strings.NewReader(string(inputJSON)))
+	body, err := q.doRequest(ctx, "/event/search", "POST", "/2_0/event/search", strings.NewReader(string(inputJSON)))
 	if err != nil {
 		return nil, err
 	}
@@ -124,37 +142,135 @@ func (q *queueitAPI) getOpenWaitingRooms() ([]WaitingRoom, error) {
 
 	q.logger.Debug("queueitAPI.getOpenWaitingRooms(): filtered out testing waiting rooms", zap.Int("count", len(rooms)))
 
+	if q.schedule != nil {
+		rooms = q.schedule.dropUnscheduled(rooms)
+	}
+
 	return rooms, nil
 }
 
+// discoverWaitingRooms returns the open waiting rooms and when they were
+// discovered, through the discovery cache when there is one. The time is
+// zero when no rooms could be discovered, err may be set otherwise when the
+// rooms of a previous discovery are returned
+func (q *queueitAPI) discoverWaitingRooms(ctx context.Context) ([]WaitingRoom, time.Time, error) {
+	if q.discovery != nil {
+		return q.discovery.get(ctx, q.getOpenWaitingRooms)
+	}
+
+	rooms, err := q.getOpenWaitingRooms(ctx)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return rooms, time.Now(), nil
+}
+
+// getWaitingRoomConfig returns the configuration of a waiting room
+func (q *queueitAPI) getWaitingRoomConfig(ctx context.Context, id string) (*WaitingRoomConfig, error) {
+	body, err := q.doRequest(ctx, "/event", "GET", fmt.Sprintf("/2_0/event/%s", id), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var config WaitingRoomConfig
+	if err := json.Unmarshal(body, &config); err != nil {
+		return nil, q.handleAPIError(body, err)
+	}
+
+	// Queue-it errors unmarshal to an empty configuration
+	if config.EventID == "" {
+		return nil, q.handleAPIError(body, nil)
+	}
+
+	return &config, nil
+}
+
+// setMaxOutflow updates the max outflow of a waiting room, in users redirected per minute
+func (q *queueitAPI) setMaxOutflow(ctx context.Context, id string, maxOutflow int) error {
+	input, err := json.Marshal(map[string]string{"MaxRedirectsPerMinute": strconv.Itoa(maxOutflow)})
+	if err != nil {
+		return err
+	}
+
+	body, err := q.doRequest(ctx, "/event", "PUT", fmt.Sprintf("/2_0/event/%s", id), bytes.NewReader(input))
+	if err != nil {
+		return err
+	}
+
+	// Queue-it answers with the updated waiting room, or an error
+	var config WaitingRoomConfig
+	if err := json.Unmarshal(body, &config); err != nil {
+		return q.handleAPIError(body, err)
+	}
+	if config.EventID == "" {
+		return q.handleAPIError(body, nil)
+	}
+
+	q.logger.Debug("queueitAPI.setMaxOutflow(): updated max outflow", zap.String("waiting_room_id", id), zap.Float64("max_outflow", float64(config.MaxRedirectsPerMinute)))
+
+	return nil
+}
+
 // sendSummaryMetrics sends StatisticsSummary metrics to a channel
 func (q *queueitAPI) sendSummaryMetrics(m *StatisticsSummary, waitingRoomID string, c chan *queueitMetric) {
 	// SUMMARY_METRIC_COUNT must be set to the number of metrics sent from here
-	c <- &queueitMetric{exportedMetricName: "queue_it_total_queue_count", value: m.TotalQueueCount, waitingRoomID: waitingRoomID}
-	c <- &queueitMetric{exportedMetricName: "queue_it_total_queue_count_before_start", value: m.TotalQueueCountBeforeStart, waitingRoomID: waitingRoomID}
-	c <- &queueitMetric{exportedMetricName: "queue_it_total_waiting_in_queue_count", value: m.TotalWaitingInQueueCount, waitingRoomID: waitingRoomID}
-	c <- &queueitMetric{exportedMetricName: "queue_it_total_left_queue_count", value: m.TotalLeftQueueCount, waitingRoomID: waitingRoomID}
-	c <- &queueitMetric{exportedMetricName: "queue_it_no_of_redirects_last_minute", value: m.NoOfRedirectsLastMinute, waitingRoomID: waitingRoomID}
-	c <- &queueitMetric{exportedMetricName: "queue_it_no_of_unique_redirects_last_minute", value: m.NoOfUniqueRedirectsLastMinute, waitingRoomID: waitingRoomID}
-	c <- &queueitMetric{exportedMetricName: "queue_it_safety_net_redirected_count", value: m.SafetyNetRedirectedCount, waitingRoomID: waitingRoomID}
-	c <- &queueitMetric{exportedMetricName: "queue_it_redirector_redirected_count", value: m.RedirectorRedirectedCount, waitingRoomID: waitingRoomID}
-	c <- &queueitMetric{exportedMetricName: "queue_it_total_redirected_count", value: m.TotalRedirectedCount, waitingRoomID: waitingRoomID}
-	c <- &queueitMetric{exportedMetricName: "queue_it_total_email_count", value: m.TotalEmailCount, waitingRoomID: waitingRoomID}
-	c <- &queueitMetric{exportedMetricName: "queue_it_total_email_notification_count", value: m.TotalEmailNotificationCount, waitingRoomID: waitingRoomID}
-	c <- &queueitMetric{exportedMetricName: "queue_it_total_old_queue_numbers", value: m.TotalOldQueueNumbers, waitingRoomID: waitingRoomID}
-	c <- &queueitMetric{exportedMetricName: "queue_it_total_exceeded_max_redirect_count", value: m.TotalExceededMaxRedirectCount, waitingRoomID: waitingRoomID}
-	c <- &queueitMetric{exportedMetricName: "queue_it_returning_queue_items_in_less_than_30s_last_min", value: m.ReturningQueueItemsInLessThan30SLastMin, waitingRoomID: waitingRoomID}
+	c <- &queueitMetric{exportedMetricName: "queue_it_total_queue_count", queueitMetricName: "TotalQueueCount", value: m.TotalQueueCount, waitingRoomID: waitingRoomID}
+	c <- &queueitMetric{exportedMetricName: "queue_it_total_queue_count_before_start", queueitMetricName: "TotalQueueCountBeforeStart", value: m.TotalQueueCountBeforeStart, waitingRoomID: waitingRoomID}
+	c <- &queueitMetric{exportedMetricName: "queue_it_total_waiting_in_queue_count", queueitMetricName: "TotalWaitingInQueueCount", value: m.TotalWaitingInQueueCount, waitingRoomID: waitingRoomID}
+	c <- &queueitMetric{exportedMetricName: "queue_it_total_left_queue_count", queueitMetricName: "TotalLeftQueueCount", value: m.TotalLeftQueueCount, waitingRoomID: waitingRoomID}
+	c <- &queueitMetric{exportedMetricName: "queue_it_no_of_redirects_last_minute", queueitMetricName: "NoOfRedirectsLastMinute", value: m.NoOfRedirectsLastMinute, waitingRoomID: waitingRoomID}
+	c <- &queueitMetric{exportedMetricName: "queue_it_no_of_unique_redirects_last_minute", queueitMetricName: "NoOfUniqueRedirectsLastMinute", value: m.NoOfUniqueRedirectsLastMinute, waitingRoomID: waitingRoomID}
+	c <- &queueitMetric{exportedMetricName: "queue_it_safety_net_redirected_count", queueitMetricName: "SafetyNetRedirectedCount", value: m.SafetyNetRedirectedCount, waitingRoomID: waitingRoomID}
+	c <- &queueitMetric{exportedMetricName: "queue_it_redirector_redirected_count", queueitMetricName: "RedirectorRedirectedCount", value: m.RedirectorRedirectedCount, waitingRoomID: waitingRoomID}
+	c <- &queueitMetric{exportedMetricName: "queue_it_total_redirected_count", queueitMetricName: "TotalRedirectedCount", value: m.TotalRedirectedCount, waitingRoomID: waitingRoomID}
+	c <- &queueitMetric{exportedMetricName: "queue_it_total_email_count", queueitMetricName: "TotalEmailCount", value: m.TotalEmailCount, waitingRoomID: waitingRoomID}
+	c <- &queueitMetric{exportedMetricName: "queue_it_total_email_notification_count", queueitMetricName: "TotalEmailNotificationCount", value: m.TotalEmailNotificationCount, waitingRoomID: waitingRoomID}
+	c <- &queueitMetric{exportedMetricName: "queue_it_total_old_queue_numbers", queueitMetricName: "TotalOldQueueNumbers", value: m.TotalOldQueueNumbers, waitingRoomID: waitingRoomID}
+	c <- &queueitMetric{exportedMetricName: "queue_it_total_exceeded_max_redirect_count", queueitMetricName: "TotalExceededMaxRedirectCount", value: m.TotalExceededMaxRedirectCount, waitingRoomID: waitingRoomID}
+	c <- &queueitMetric{exportedMetricName: "queue_it_returning_queue_items_in_less_than_30s_last_min", queueitMetricName: "ReturningQueueItemsInLessThan30SLastMin", value: m.ReturningQueueItemsInLessThan30SLastMin, waitingRoomID: waitingRoomID}
+}
+
+// parseTimestamp parses an RFC3339 Queue-it timestamp, returning the zero time
+// when it is missing or malformed as timestamps are informative only
+func parseTimestamp(s string) time.Time {
+	ts, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return ts
+}
+
+// forwardSummaryMetrics sends StatisticsSummary metrics to a channel once set has been applied to each of them
+func (q *queueitAPI) forwardSummaryMetrics(m *StatisticsSummary, waitingRoomID string, c chan *queueitMetric, set func(*queueitMetric)) {
+	summary := make(chan *queueitMetric, SUMMARY_METRIC_COUNT)
+	q.sendSummaryMetrics(m, waitingRoomID, summary)
+
+	for n := 0; n < SUMMARY_METRIC_COUNT; n++ {
+		metric := <-summary
+		set(metric)
+		c <- metric
+	}
+}
+
+// failSummaryMetrics sends every StatisticsSummary metric flagged with err to a channel
+func (q *queueitAPI) failSummaryMetrics(waitingRoomID string, err error, c chan *queueitMetric) {
+	q.forwardSummaryMetrics(&StatisticsSummary{}, waitingRoomID, c, func(m *queueitMetric) {
+		m.err = err
+	})
 }
 
 // getWaitingRoomQueueStatisticsSummary sends metrics from the queue statistics summary api
 // to the provided channel
-// If the API call fails the challen will be fed a nil value
-func (q *queueitAPI) getWaitingRoomQueueStatisticsSummary(id string, c chan *queueitMetric) {
-	body, err := q.doRequest("GET", fmt.Sprintf("/2_0/event/%s/queue/statistics/summary", id), nil)
+// If the API call fails the channel will be fed metrics flagged with the error
+func (q *queueitAPI) getWaitingRoomQueueStatisticsSummary(ctx context.Context, id string, c chan *queueitMetric) {
+	body, err := q.doRequest(ctx, "/summary", "GET", fmt.Sprintf("/2_0/event/%s/queue/statistics/summary", id), nil)
 	if err != nil {
-		// throw returned error away but log it
+		// log the API error if any
 		q.handleAPIError(body, err)
-		c <- nil
+		q.failSummaryMetrics(id, err, c)
+		return
 	}
 
 	// turn JSON map into list of metrics
@@ -163,38 +279,42 @@ func (q *queueitAPI) getWaitingRoomQueueStatisticsSummary(id string, c chan *que
 	if err != nil {
 		q.logger.Info(
 			"queueitAPI.getWaitingRoomQueueStatisticsSummary(): failed to unmarshal stats",
-			zap.String("body", string(body)),
+			zap.Int("bodySize", len(body)),
 			zap.Error(err),
 		)
-		c <- nil
+		q.failSummaryMetrics(id, err, c)
+		return
 	}
 
-	// send metrics to channel
-	q.sendSummaryMetrics(&metrics, id, c)
+	// send metrics to channel, stamped with the summary version
+	q.forwardSummaryMetrics(&metrics, id, c, func(m *queueitMetric) {
+		m.timestamp = metrics.VersionTimestamp.Time
+	})
 }
 
-// getStatisticsDetailsMetrics sends statistics details metrics to channel
-func (q *queueitAPI) getStatisticsDetailsMetrics(id string, c chan *queueitMetric) {
-	statisticsDetailsMetrics := []*queueitMetric{
-		{queueitMetricName: "queuebeforeeventinflow", exportedMetricName: "queue_it_queue_before_event_inflow_count", description: "The amount of users who have joined the pre-queue"},
-		{queueitMetricName: "queueinflow", exportedMetricName: "queue_it_queue_inflow_count", description: "Users who have joined either the pre-queue or the queue"},
-		{queueitMetricName: "queueuniqueoutflow", exportedMetricName: "queue_it_queue_unique_outflow_count", description: "The number of initial queue redirects per minute (first redirect of the queue ID)"},
-		{queueitMetricName: "queueoutflow", exportedMetricName: "queue_it_queue_outflow_count", description: "The amount of queue numbers which have been redirected from the queue"},
-		{queueitMetricName: "safetynetoutflow", exportedMetricName: "queue_it_safety_net_outflow_count", description: "Redirected queue numbers which were redirected without having waited in the queue (requires Always Visible, so this value is irrelevant in your case)"},
-		{queueitMetricName: "queueidsinqueue", exportedMetricName: "queue_it_queue_ids_in_queue_count", description: "The amount of Queue IDs currently waiting in line"},
-		{queueitMetricName: "queueuniqueinflow", exportedMetricName: "queue_it_queue_unique_inflow_count", description: "The amount of new (unique) Queue IDs entering the queue per minute"},
-		{queueitMetricName: "queueidscanceled", exportedMetricName: "queue_it_queue_ids_canceled_count", description: "The amount of Queue IDs which have been canceled by Cancel Action or API"},
-		{queueitMetricName: "notificationfirst", exportedMetricName: "queue_it_notification_first_count", description: "The amount of users who received the first email notification upon signing up"},
-		{queueitMetricName: "notificationyourturn", exportedMetricName: "queue_it_notification_your_turn_count", description: "The amount of users who received the It's Your Turn email notification"},
-		{queueitMetricName: "exceededmaxredirectcount", exportedMetricName: "queue_it_exceeded_max_redirect_count", description: "The amount of visitors who pass through the waiting room more times than they are allowed (as configured in the Waiting Room Settings)"},
-		{queueitMetricName: "maxoutflow", exportedMetricName: "queue_it_max_out_flow", description: "The highest amount of Queue IDs which are allowed to be redirected to your site per minute"},
-		{queueitMetricName: "queueexpectedwaittime", exportedMetricName: "queue_it_queue_expected_wait_time", description: "For users arriving at a given time, this is the predicted wait time"},
-		{queueitMetricName: "queueactualwaittime", exportedMetricName: "queue_it_queue_actual_wait_time", description: "The actual amount of minutes wait time in the queue"},
-		{queueitMetricName: "returningqueueitemsinlessthan30s", exportedMetricName: "queue_it_returning_queue_items_in_less_than_30s", description: "If a Queue ID is returning to the queue less than 30 seconds after it was redirected to the target site, we count it as a fast re-entering user"},
-		{queueitMetricName: "oldqueuenumbers", exportedMetricName: "queue_it_old_queue_numbers_count", description: "The amount of Queue IDs who have been first in line and did not choose to be redirected to the target site"},
-		{queueitMetricName: "redirectedpercentage", exportedMetricName: "queue_it_redirected_percentage", description: "Percent of users who took their turn within a minute"},
-	}
+// statisticsDetailsMetrics are fetched from the queue statistics details api for every waiting room
+var statisticsDetailsMetrics = []*queueitMetric{
+	{queueitMetricName: "queuebeforeeventinflow", exportedMetricName: "queue_it_queue_before_event_inflow_count", description: "The amount of users who have joined the pre-queue"},
+	{queueitMetricName: "queueinflow", exportedMetricName: "queue_it_queue_inflow_count", description: "Users who have joined either the pre-queue or the queue"},
+	{queueitMetricName: "queueuniqueoutflow", exportedMetricName: "queue_it_queue_unique_outflow_count", description: "The number of initial queue redirects per minute (first redirect of the queue ID)"},
+	{queueitMetricName: "queueoutflow", exportedMetricName: "queue_it_queue_outflow_count", description: "The amount of queue numbers which have been redirected from the queue"},
+	{queueitMetricName: "safetynetoutflow", exportedMetricName: "queue_it_safety_net_outflow_count", description: "Redirected queue numbers which were redirected without having waited in the queue (requires Always Visible, so this value is irrelevant in your case)"},
+	{queueitMetricName: "queueidsinqueue", exportedMetricName: "queue_it_queue_ids_in_queue_count", description: "The amount of Queue IDs currently waiting in line"},
+	{queueitMetricName: "queueuniqueinflow", exportedMetricName: "queue_it_queue_unique_inflow_count", description: "The amount of new (unique) Queue IDs entering the queue per minute"},
+	{queueitMetricName: "queueidscanceled", exportedMetricName: "queue_it_queue_ids_canceled_count", description: "The amount of Queue IDs which have been canceled by Cancel Action or API"},
+	{queueitMetricName: "notificationfirst", exportedMetricName: "queue_it_notification_first_count", description: "The amount of users who received the first email notification upon signing up"},
+	{queueitMetricName: "notificationyourturn", exportedMetricName: "queue_it_notification_your_turn_count", description: "The amount of users who received the It's Your Turn email notification"},
+	{queueitMetricName: "exceededmaxredirectcount", exportedMetricName: "queue_it_exceeded_max_redirect_count", description: "The amount of visitors who pass through the waiting room more times than they are allowed (as configured in the Waiting Room Settings)"},
+	{queueitMetricName: "maxoutflow", exportedMetricName: "queue_it_max_out_flow", description: "The highest amount of Queue IDs which are allowed to be redirected to your site per minute"},
+	{queueitMetricName: "queueexpectedwaittime", exportedMetricName: "queue_it_queue_expected_wait_time", description: "For users arriving at a given time, this is the predicted wait time"},
+	{queueitMetricName: "queueactualwaittime", exportedMetricName: "queue_it_queue_actual_wait_time", description: "The actual amount of minutes wait time in the queue"},
+	{queueitMetricName: "returningqueueitemsinlessthan30s", exportedMetricName: "queue_it_returning_queue_items_in_less_than_30s", description: "If a Queue ID is returning to the queue less than 30 seconds after it was redirected to the target site, we count it as a fast re-entering user"},
+	{queueitMetricName: "oldqueuenumbers", exportedMetricName: "queue_it_old_queue_numbers_count", description: "The amount of Queue IDs who have been first in line and did not choose to be redirected to the target site"},
+	{queueitMetricName: "redirectedpercentage", exportedMetricName: "queue_it_redirected_percentage", description: "Percent of users who took their turn within a minute"},
+}
 
+// getStatisticsDetailsMetrics sends statistics details metrics to channel
+func (q *queueitAPI) getStatisticsDetailsMetrics(ctx context.Context, id string, c chan *queueitMetric) {
 	// Export another metric for accumulated total at request time (SumOffset field)
 	accumulatedMetrics := map[string]bool{}
 
@@ -202,47 +322,54 @@ func (q *queueitAPI) getStatisticsDetailsMetrics(id string, c chan *queueitMetri
 	then := now.Add(-1 * time.Minute)
 
 	for _, m := range statisticsDetailsMetrics {
-		go q.getWaitingRoomQueueStatisticsDetail(id, m, accumulatedMetrics[m.queueitMetricName], then, now, c)
+		from := then
+		// flow counters need every bucket since the last counted one
+		if q.flowCounters != nil && isFlowStatistic(m.queueitMetricName) {
+			from = q.flowCounters.since(id, m.queueitMetricName, then, now)
+		}
+		go q.getWaitingRoomQueueStatisticsDetail(ctx, id, m, accumulatedMetrics[m.queueitMetricName], from, now, c)
 	}
 }
 
 // getWaitingRoomQueueStatisticsDetail sends a metric from the queue statistics details api
 // to the provided channel
-// If the API call fails the challen will be fed a nil value
-func (q *queueitAPI) getWaitingRoomQueueStatisticsDetail(id string, m *queueitMetric, sendAccumulatedMetric bool, from time.Time, to time.Time, statsChan chan *queueitMetric) {
+// If the API call fails the channel will be fed metrics flagged with the error
+func (q *queueitAPI) getWaitingRoomQueueStatisticsDetail(ctx context.Context, id string, m *queueitMetric, sendAccumulatedMetric bool, from time.Time, to time.Time, statsChan chan *queueitMetric) {
 	fromQueryParam := url.QueryEscape(from.Format(time.RFC3339))
 	toQueryParam := url.QueryEscape(to.Format(time.RFC3339))
 
 	q.logger.Debug("queueitAPI.getWaitingRoomQueueStatisticsDetails(): getting statistics details", zap.String("waitingRoomId", id), zap.Time("from", from), zap.Time("to", to))
 
-	body, err := q.doRequest("GET", fmt.Sprintf("/2_0/event/%s/queue/statistics/details/%s?from=%s&to=%s", id, m.queueitMetricName, fromQueryParam, toQueryParam), nil)
-	if err != nil {
-		// throw returned error away but log it
-		q.handleAPIError(body, err)
-		statsChan <- nil
-	}
-
 	var metric StatisticsDetail
-	err = json.Unmarshal(body, &metric)
+	body, err := q.doRequest(withSpanAttributes(ctx, ATTRIBUTE_STATISTIC.String(m.queueitMetricName)), "/details/"+m.queueitMetricName, "GET", fmt.Sprintf("/2_0/event/%s/queue/statistics/details/%s?from=%s&to=%s", id, m.queueitMetricName, fromQueryParam, toQueryParam), nil)
 	if err != nil {
+		// log the API error if any
+		q.handleAPIError(body, err)
+	} else if err = json.Unmarshal(body, &metric); err != nil {
 		q.logger.Info("queueitAPI.parseStatisticsDetailMetrics(): failed to unmarshal stats", zap.Error(err))
-		statsChan <- nil
 	}
 
 	// deal with potentially empty Entries array
 	var value float64
-	if len(metric.Entries) == 0 {
+	if err == nil && len(metric.Entries) == 0 {
 		q.logger.Info("queueitAPI.parseStatisticsDetailMetrics(): stat detail metric has no value", zap.String("type", m.queueitMetricName))
-	} else {
-		value = metric.Entries[0].Sum
+	} else if err == nil {
+		value = metric.Entries[lastMinuteEntry(&metric, to)].Sum
 	}
 
-	statsChan <- &queueitMetric{
+	detail := &queueitMetric{
 		exportedMetricName: m.exportedMetricName,
 		queueitMetricName:  m.queueitMetricName,
+		description:        m.description,
 		waitingRoomID:      id,
 		value:              value,
+		timestamp:          parseTimestamp(metric.VersionTimestamp),
+		err:                err,
+	}
+	if err == nil && q.flowCounters != nil && isFlowStatistic(m.queueitMetricName) {
+		detail.flow = newFlowDetail(&metric, to)
 	}
+	statsChan <- detail
 
 	if sendAccumulatedMetric {
 		// remove _count form original already exporter metric
@@ -255,58 +382,169 @@ func (q *queueitAPI) getWaitingRoomQueueStatisticsDetail(id string, m *queueitMe
 			queueitMetricName:  m.queueitMetricName,
 			waitingRoomID:      id,
 			value:              metric.SumOffset,
+			timestamp:          parseTimestamp(metric.VersionTimestamp),
+			err:                err,
 		}
 	}
 }
 
+// lastMinuteEntry returns the index of the entry of a statistics detail
+// covering the minute before to, the first one when it can't be told
+func lastMinuteEntry(d *StatisticsDetail, to time.Time) int {
+	from := parseTimestamp(d.From)
+	if from.IsZero() {
+		return 0
+	}
+
+	interval := time.Duration(d.Interval) * time.Minute
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	i := int(to.Add(-time.Minute).Sub(from) / interval)
+
+	return max(0, min(i, len(d.Entries)-1))
+}
+
 // getMetrics queries the api for metrics from all active waiting rooms
 func (q *queueitAPI) getMetrics() ([]*queueitMetric, error) {
-	metrics := make([]*queueitMetric, 0)
+	return q.poll().metrics()
+}
+
+// poll discovers active waiting rooms and fetches all their statistics
+func (q *queueitAPI) poll() *poll {
+	ctx, span := tracer.Start(q.ctx, "poll")
+	defer span.End()
+
+	p := &poll{start: time.Now()}
+	defer func() {
+		p.duration = time.Since(p.start)
+	}()
 
 	// Get active rooms we want to collect metrics for
-	rooms, err := q.getOpenWaitingRooms()
+	rooms, discoveredAt, err := q.discoverWaitingRooms(ctx)
+	if discoveredAt.IsZero() {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		p.err = err
+		return p
+	}
 	if err != nil {
-		return nil, err
+		// keep polling the rooms of the last successful discovery
+		q.logger.Warn("queueitAPI.poll(): failed to discover waiting rooms, polling the last discovered ones", zap.Time("discoveredAt", discoveredAt), zap.Error(err))
+		span.RecordError(err)
+		p.discoveryErr = err
 	}
+	span.SetAttributes(ATTRIBUTE_ROOM_COUNT.Int(len(rooms)))
+	p.discovered = true
+	p.discoveredAt = discoveredAt
 
 	if len(rooms) == 0 {
-		q.logger.Info("queueitAPI.getMetrics(): did not find any waiting room")
-		return nil, nil
+		q.logger.Info("queueitAPI.poll(): did not find any waiting room")
+		return p
 	}
 
-	q.logger.Debug("queueitAPI.getMetrics(): found rooms", zap.Int("count", len(rooms)))
+	q.logger.Debug("queueitAPI.poll(): found rooms", zap.Int("count", len(rooms)))
 
-	q.logger.Debug("queueitAPI.getMetrics(): number of expected metrics", zap.Int("count", TOTAL_METRIC_COUNT))
+	p.rooms = q.pollWaitingRooms(ctx, rooms)
+
+	return p
+}
+
+// getWaitingRoomsMetrics queries the api for summary and detail metrics of the provided waiting rooms
+func (q *queueitAPI) getWaitingRoomsMetrics(ctx context.Context, rooms []WaitingRoom) ([]*queueitMetric, error) {
+	p := &poll{rooms: q.pollWaitingRooms(ctx, rooms)}
+	return p.metrics()
+}
+
+// pollWaitingRooms concurrently fetches every statistic of the provided waiting rooms
+func (q *queueitAPI) pollWaitingRooms(ctx context.Context, rooms []WaitingRoom) []*roomPoll {
+	polls := make([]*roomPoll, len(rooms))
+
+	var wg sync.WaitGroup
+	for i, room := range rooms {
+		// rooms that are not due keep their last poll
+		if q.schedule != nil {
+			if skipped := q.schedule.skip(room); skipped != nil {
+				polls[i] = skipped
+				continue
+			}
+		}
+
+		wg.Add(1)
+		go func(i int, room WaitingRoom) {
+			defer wg.Done()
+			polls[i] = q.pollWaitingRoom(ctx, room)
+			if q.schedule != nil {
+				q.schedule.polled(polls[i])
+			}
+		}(i, room)
+	}
+	wg.Wait()
+
+	if q.schedule != nil {
+		q.schedule.retain(rooms)
+	}
+
+	return polls
+}
+
+// pollWaitingRoom fetches every summary and detail statistic of a waiting room.
+// Failed statistics are kept, flagged with their error
+func (q *queueitAPI) pollWaitingRoom(ctx context.Context, room WaitingRoom) *roomPoll {
+	ctx, span := tracer.Start(ctx, "poll waiting room", trace.WithAttributes(ATTRIBUTE_WAITING_ROOM_ID.String(room.EventID)))
+	defer span.End()
+	ctx = withSpanAttributes(ctx, ATTRIBUTE_WAITING_ROOM_ID.String(room.EventID))
+
+	p := &roomPoll{
+		room:    room,
+		start:   time.Now(),
+		metrics: make([]*queueitMetric, 0, TOTAL_METRIC_COUNT),
+	}
 
 	statsChan := make(chan *queueitMetric, TOTAL_METRIC_COUNT)
-	defer func() {
-		q.logger.Debug("queueitAPI.getMetrics(): cleaning up, closing channel")
-		close(statsChan)
-	}()
 
 	// fan out fetching of summary and detail metrics
-	for _, room := range rooms {
-		// get summary metrics for waiting room
-		go q.getWaitingRoomQueueStatisticsSummary(room.EventID, statsChan)
-		// get waiting room detail metrics for the last minute
-		go q.getStatisticsDetailsMetrics(room.EventID, statsChan)
+	// get summary metrics for waiting room
+	go q.getWaitingRoomQueueStatisticsSummary(ctx, room.EventID, statsChan)
+	// get waiting room detail metrics for the last minute
+	go q.getStatisticsDetailsMetrics(ctx, room.EventID, statsChan)
+
+	// get waiting room configuration alongside its statistics
+	var configDone chan struct{}
+	if q.fetchRoomConfig {
+		configDone = make(chan struct{})
+		go func() {
+			defer close(configDone)
+			p.config, p.configErr = q.getWaitingRoomConfig(ctx, room.EventID)
+		}()
 	}
 
-	// fan in metrics
-	for n := 0; n < len(rooms)*TOTAL_METRIC_COUNT; n++ {
+	// fan in metrics, every statistic sends exactly one metric, failed or not
+	for n := 0; n < TOTAL_METRIC_COUNT; n++ {
 		stat := <-statsChan
+		p.metrics = append(p.metrics, stat)
 
-		if stat == nil {
-			return nil, fmt.Errorf("queueitAPI.getMetrics(): failed to get statistics for waiting room")
-		}
-
-		metrics = append(metrics, stat)
-
-		q.logger.Debug("queueitAPI.getMetrics(): done getting metrics",
+		q.logger.Debug("queueitAPI.pollWaitingRoom(): done getting metric",
 			zap.String("waiting_room_id", stat.waitingRoomID),
 			zap.Float64(stat.queueitMetricName, stat.value),
+			zap.Error(stat.err),
 		)
 	}
 
-	return metrics, nil
+	if configDone != nil {
+		<-configDone
+		if p.configErr != nil {
+			q.logger.Info("queueitAPI.pollWaitingRoom(): failed to get waiting room config", zap.String("waiting_room_id", room.EventID), zap.Error(p.configErr))
+		}
+	}
+
+	p.metrics = append(p.metrics, deriveMetrics(room.EventID, p.metrics)...)
+	p.duration = time.Since(p.start)
+
+	if failed := p.failed(); failed > 0 {
+		span.SetStatus(codes.Error, fmt.Sprintf("%d statistics failed", failed))
+	}
+
+	return p
 }
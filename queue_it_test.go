@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
 	"time"
@@ -78,7 +80,9 @@ func SkipTestGetMetrics(t *testing.T) {
 	logger, _ := zap.NewDevelopment()
 	defer logger.Sync()
 	q := &queueitAPI{
+		ctx:     context.Background(),
 		logger:  logger,
+		client:  http.DefaultClient,
 		apiKey:  os.Getenv("QUEUE_IT_API_KEY"),
 		baseUrl: os.Getenv("QUEUE_IT_BASE_URL"),
 	}
@@ -89,7 +93,9 @@ func SkipBenchmarkGetMetrics(b *testing.B) {
 	logger, _ := zap.NewProduction()
 	defer logger.Sync()
 	q := &queueitAPI{
+		ctx:     context.Background(),
 		logger:  logger,
+		client:  http.DefaultClient,
 		apiKey:  os.Getenv("QUEUE_IT_API_KEY"),
 		baseUrl: os.Getenv("QUEUE_IT_BASE_URL"),
 	}
@@ -103,7 +109,9 @@ func SkipTestGetWaitingRoomQueueStatisticsDetail(t *testing.T) {
 	logger, _ := zap.NewDevelopment()
 	defer logger.Sync()
 	q := &queueitAPI{
+		ctx:     context.Background(),
 		logger:  logger,
+		client:  http.DefaultClient,
 		apiKey:  os.Getenv("QUEUE_IT_API_KEY"),
 		baseUrl: os.Getenv("QUEUE_IT_BASE_URL"),
 	}
@@ -116,7 +124,7 @@ func SkipTestGetWaitingRoomQueueStatisticsDetail(t *testing.T) {
 	c := make(chan *queueitMetric, 2)
 	now := time.Now()
 	then := now.Add(-1 * time.Minute)
-	q.getWaitingRoomQueueStatisticsDetail("foo", m, true, then, now, c)
+	q.getWaitingRoomQueueStatisticsDetail(context.Background(), "foo", m, true, then, now, c)
 	go func() {
 		time.Sleep(5 * time.Second)
 		close(c)
@@ -126,3 +134,18 @@ func SkipTestGetWaitingRoomQueueStatisticsDetail(t *testing.T) {
 		fmt.Println("->>", m)
 	}
 }
+
+// A failing statistic must fail the whole fan in without leaving
+// goroutines blocked on, or panicking while sending to, the channel
+func TestGetWaitingRoomsMetricsFailedStatistic(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html>bad gateway</html>"))
+	}))
+	defer server.Close()
+
+	q := newQueueitAPI(context.Background(), zap.NewNop(), http.DefaultClient, server.URL, "a-b-c", true)
+
+	if _, err := q.getWaitingRoomsMetrics(context.Background(), []WaitingRoom{{EventID: "1"}, {EventID: "2"}}); err == nil {
+		t.Error("expected an error")
+	}
+}
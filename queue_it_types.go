@@ -1,6 +1,10 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -16,14 +20,106 @@ type queueitMetric struct {
 	description        string
 	waitingRoomID      string
 	value              float64
+	// upstream time the value was computed at, zero when unknown
+	timestamp time.Time
+	// set when the metric could not be fetched from the Queue-it api
+	err error
+	// completed buckets of a statistics detail counted by flow counters, nil otherwise
+	flow *flowDetail
+}
+
+// poll represents the outcome of discovering waiting rooms and fetching their statistics
+type poll struct {
+	start    time.Time
+	duration time.Duration
+	// whether waiting rooms were discovered, err is a discovery error otherwise
+	discovered bool
+	err        error
+	// when the polled rooms were discovered, earlier than start when cached
+	discoveredAt time.Time
+	// error of a failed discovery when the rooms of a previous one were polled
+	discoveryErr error
+	rooms        []*roomPoll
+}
+
+// roomPoll represents the outcome of fetching every statistic of a waiting room
+type roomPoll struct {
+	room     WaitingRoom
+	start    time.Time
+	duration time.Duration
+	// fetched metrics, including failed ones
+	metrics []*queueitMetric
+	// configuration of the room, nil when not fetched or configErr is set
+	config    *WaitingRoomConfig
+	configErr error
+	// whether the statistics are those of a previous poll, fetched at start
+	reused bool
+}
+
+// metrics returns every metric of a poll or the first error that occurred
+func (p *poll) metrics() ([]*queueitMetric, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	metrics := make([]*queueitMetric, 0)
+	for _, r := range p.rooms {
+		for _, m := range r.metrics {
+			if m.err != nil {
+				return nil, fmt.Errorf("failed to get %s statistic for waiting room %s: %w", m.queueitMetricName, m.waitingRoomID, m.err)
+			}
+
+			metrics = append(metrics, m)
+		}
+	}
+
+	return metrics, nil
+}
+
+// reachedQueueit reports whether a poll talked to Queue-it: waiting rooms were
+// discovered and at least one statistic was fetched when there was any to fetch
+func (p *poll) reachedQueueit() bool {
+	if !p.discovered {
+		return false
+	}
+
+	total, failed := 0, 0
+	for _, r := range p.rooms {
+		total += len(r.metrics)
+		failed += r.failed()
+	}
+
+	return total == 0 || failed < total
+}
+
+// failed returns the number of metrics of a room that could not be fetched
+func (r *roomPoll) failed() int {
+	failed := 0
+	for _, m := range r.metrics {
+		if m.err != nil {
+			failed++
+		}
+	}
+
+	return failed
 }
 
 // queueitAPI represents a Queue-it API client
 type queueitAPI struct {
+	ctx                  context.Context
 	logger               *zap.Logger
+	client               *http.Client
 	apiKey               string
 	baseUrl              string
 	omitTestWaitingRooms bool
+	// whether the configuration of every polled waiting room is fetched
+	fetchRoomConfig bool
+	// counters of flow statistics, nil when not maintained
+	flowCounters *flowCounters
+	// cache of discovered waiting rooms, nil when they are discovered on every poll
+	discovery *discoveryCache
+	// per-phase polling of waiting rooms, nil when every room is polled every time
+	schedule *pollSchedule
 }
 
 // Custom unmarshallers
@@ -53,6 +149,26 @@ func (t *stringToTime) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// stringToFloat is a number the Queue-it API may encode as a string
+type stringToFloat float64
+
+func (f *stringToFloat) UnmarshalJSON(data []byte) error {
+	str := strings.Replace(string(data), "\"", "", 2)
+	if str == "" || str == "null" {
+		*f = 0
+		return nil
+	}
+
+	value, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		return err
+	}
+
+	*f = stringToFloat(value)
+
+	return nil
+}
+
 type StatisticsSummary struct {
 	VersionTimestamp                        stringToTime `json:"VersionTimestamp"`
 	TotalQueueCount                         float64      `json:",string"`
@@ -76,6 +192,7 @@ type StatisticsSummary struct {
 type WaitingRoom struct {
 	EventID                    string
 	DisplayName                string
+	Phase                      string
 	PreQueueStartsMinuesBefore int          `json:"PreQueueStartsMinuesBefore,string"`
 	EventStartTime             stringToTime `json:"EventStartTime"`
 	EventEndTime               stringToTime `json:"EventEndTime"`
@@ -108,3 +225,20 @@ type StatisticsDetail struct {
 	Entries          []StatisticsDetailEntry
 	SumOffset        float64 `json:",string"`
 }
+
+// WaitingRoomConfig represents the configuration of a waiting room as returned
+// by the Queue-it event API
+type WaitingRoomConfig struct {
+	EventID                      string
+	TargetUrl                    string
+	MaxRedirectsPerMinute        stringToFloat
+	MaxNoOfRedirectsPerQueueId   stringToFloat
+	QueueNumberValidityInMinutes stringToFloat
+	SafetyNetMode                string
+	AfterEventLogic              string
+	IdleQueueLogic               string
+	CustomLayout                 string
+	Language                     string
+	JavaScriptSupportEnabled     stringToBool
+	TargetUrlSupportEnabled      stringToBool
+}
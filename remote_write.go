@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"go.uber.org/zap"
+)
+
+// remoteWriteConfig holds the flags of the remote-write subcommand
+type remoteWriteConfig struct {
+	url             string
+	username        string
+	passwordFile    string
+	bearerTokenFile string
+	maxRetries      int
+	minBackoff      time.Duration
+	timeout         time.Duration
+}
+
+// registerFlags adds the remote write flags to a flag set
+func (c *remoteWriteConfig) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.url, "url", "", "Prometheus remote write endpoint, e.g. http://mimir/api/v1/push")
+	fs.StringVar(&c.username, "basic-auth.username", "", "Username for basic auth against the remote write endpoint")
+	fs.StringVar(&c.passwordFile, "basic-auth.password-file", "", "File holding the password for basic auth against the remote write endpoint")
+	fs.StringVar(&c.bearerTokenFile, "bearer-token-file", "", "File holding a bearer token for the remote write endpoint")
+	fs.IntVar(&c.maxRetries, "max-retries", 3, "Maximum number of retries of a write failing with a 5xx status or a network error")
+	fs.DurationVar(&c.minBackoff, "min-backoff", time.Second, "Initial delay between retries, doubled after each retry")
+	fs.DurationVar(&c.timeout, "timeout", 30*time.Second, "Timeout of a single write request")
+}
+
+// newClient validates the configuration and returns a remoteWriteClient
+func (c *remoteWriteConfig) newClient() (*remoteWriteClient, error) {
+	if c.url == "" {
+		return nil, errors.New("please provide a remote write endpoint as -url")
+	}
+
+	if c.passwordFile != "" && c.bearerTokenFile != "" {
+		return nil, errors.New("-basic-auth.password-file and -bearer-token-file are mutually exclusive")
+	}
+
+	rw := &remoteWriteClient{
+		client:     &http.Client{Timeout: c.timeout},
+		url:        c.url,
+		username:   c.username,
+		maxRetries: c.maxRetries,
+		minBackoff: c.minBackoff,
+	}
+
+	if c.passwordFile != "" {
+		content, err := os.ReadFile(c.passwordFile)
+		if err != nil {
+			return nil, errors.New("cannot read file from -basic-auth.password-file: " + c.passwordFile)
+		}
+		rw.password = strings.TrimSpace(string(content))
+	}
+
+	if c.bearerTokenFile != "" {
+		content, err := os.ReadFile(c.bearerTokenFile)
+		if err != nil {
+			return nil, errors.New("cannot read file from -bearer-token-file: " + c.bearerTokenFile)
+		}
+		rw.bearerToken = strings.TrimSpace(string(content))
+	}
+
+	return rw, nil
+}
+
+// timeSeries is a single sample of a Prometheus time series
+type timeSeries struct {
+	name          string
+	waitingRoomID string
+	value         float64
+	timestamp     time.Time
+}
+
+// pollTimeSeries returns the samples of a poll. Statistics are timestamped with
+// their upstream timestamp when known, with the poll start otherwise. Failed
+// statistics are left out
+func pollTimeSeries(p *poll) []timeSeries {
+	series := make([]timeSeries, 0)
+
+	up := 1.0
+	if _, err := p.metrics(); err != nil {
+		up = 0
+	}
+	series = append(series,
+		timeSeries{name: "queue_it_up", value: up, timestamp: p.start},
+		timeSeries{name: "queue_it_collector_collect_duration_seconds", value: p.duration.Seconds(), timestamp: p.start},
+	)
+
+	for _, r := range p.rooms {
+		for _, m := range r.metrics {
+			if m.err != nil {
+				continue
+			}
+
+			ts := m.timestamp
+			if ts.IsZero() {
+				ts = r.start
+			}
+
+			series = append(series, timeSeries{name: m.exportedMetricName, waitingRoomID: m.waitingRoomID, value: m.value, timestamp: ts})
+		}
+	}
+
+	return series
+}
+
+// writeRequest returns the remote write request of series. Samples are
+// grouped by series and sorted by time; samples of a series sharing a
+// timestamp, which receivers reject as duplicates, collapse into the last one
+func writeRequest(series []timeSeries) *prompb.WriteRequest {
+	req := &prompb.WriteRequest{}
+	index := make(map[string]int)
+
+	for _, s := range series {
+		// labels must be sorted by name
+		labels := []prompb.Label{{Name: "__name__", Value: s.name}}
+		if s.waitingRoomID != "" {
+			labels = append(labels, prompb.Label{Name: "waiting_room_id", Value: s.waitingRoomID})
+		}
+
+		key := s.name + "\xff" + s.waitingRoomID
+		i, ok := index[key]
+		if !ok {
+			i = len(req.Timeseries)
+			index[key] = i
+			req.Timeseries = append(req.Timeseries, prompb.TimeSeries{Labels: labels})
+		}
+		req.Timeseries[i].Samples = append(req.Timeseries[i].Samples, prompb.Sample{Value: s.value, Timestamp: s.timestamp.UnixMilli()})
+	}
+
+	for i := range req.Timeseries {
+		samples := req.Timeseries[i].Samples
+		sort.SliceStable(samples, func(a, b int) bool { return samples[a].Timestamp < samples[b].Timestamp })
+
+		collapsed := samples[:0]
+		for _, sample := range samples {
+			if n := len(collapsed); n > 0 && collapsed[n-1].Timestamp == sample.Timestamp {
+				collapsed[n-1] = sample
+				continue
+			}
+			collapsed = append(collapsed, sample)
+		}
+		req.Timeseries[i].Samples = collapsed
+	}
+
+	return req
+}
+
+// remoteWriteClient writes samples to a Prometheus remote write endpoint
+type remoteWriteClient struct {
+	client      *http.Client
+	url         string
+	username    string
+	password    string
+	bearerToken string
+	maxRetries  int
+	minBackoff  time.Duration
+}
+
+// recoverableError is a write failure worth retrying
+type recoverableError struct {
+	error
+}
+
+// write sends series in a single request, retrying on 5xx and network errors
+func (c *remoteWriteClient) write(ctx context.Context, logger *zap.Logger, series []timeSeries) error {
+	content, err := writeRequest(series).Marshal()
+	if err != nil {
+		return err
+	}
+	body := snappy.Encode(nil, content)
+	backoff := c.minBackoff
+
+	for attempt := 0; ; attempt++ {
+		err := c.send(ctx, body)
+		if err == nil {
+			return nil
+		}
+
+		var recoverable recoverableError
+		if !errors.As(err, &recoverable) || attempt >= c.maxRetries {
+			return err
+		}
+
+		logger.Warn("remoteWriteClient.write(): retrying failed write", zap.Int("attempt", attempt+1), zap.Duration("backoff", backoff), zap.Error(err))
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// send executes a single write request
+func (c *remoteWriteClient) send(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", c.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", SERVICE_NAME+"/"+version)
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	if c.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.bearerToken)
+	} else if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return recoverableError{err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("remote write returned HTTP status %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	if resp.StatusCode/100 == 5 {
+		return recoverableError{err}
+	}
+
+	return err
+}
+
+// runRemoteWrite polls every waiting room once and writes the samples to a
+// remote write endpoint. It exits non-zero when the poll or the write failed
+func runRemoteWrite(args []string) int {
+	var cfg commandConfig
+	var rwCfg remoteWriteConfig
+
+	fs := newCommandFlagSet("remote-write", &cfg)
+	rwCfg.registerFlags(fs)
+	fs.Parse(args)
+
+	rw, err := rwCfg.newClient()
+	if err != nil {
+		return exitCode(err)
+	}
+
+	cc, err := newCommandContext(&cfg)
+	if err != nil {
+		return exitCode(err)
+	}
+	defer cc.logger.Sync()
+
+	p := cc.api.poll()
+	series := pollTimeSeries(p)
+
+	if err := rw.write(context.Background(), cc.logger, series); err != nil {
+		return exitCode(fmt.Errorf("failed to write %d samples: %w", len(series), err))
+	}
+
+	if _, err := p.metrics(); err != nil {
+		return exitCode(err)
+	}
+
+	fmt.Fprintf(cc.stdout, "ok: wrote %d samples\n", len(series))
+
+	return 0
+}
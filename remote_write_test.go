@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"go.uber.org/zap"
+)
+
+// decodeWriteRequest decodes the samples of a WriteRequest
+func decodeWriteRequest(t *testing.T, b []byte) []timeSeries {
+	var req prompb.WriteRequest
+	if err := req.Unmarshal(b); err != nil {
+		t.Fatal(err)
+	}
+
+	series := make([]timeSeries, 0)
+	for _, ts := range req.Timeseries {
+		var s timeSeries
+		for _, l := range ts.Labels {
+			switch l.Name {
+			case "__name__":
+				s.name = l.Value
+			case "waiting_room_id":
+				s.waitingRoomID = l.Value
+			}
+		}
+		for _, sample := range ts.Samples {
+			s.value, s.timestamp = sample.Value, time.UnixMilli(sample.Timestamp)
+			series = append(series, s)
+		}
+	}
+
+	return series
+}
+
+func TestRemoteWrite(t *testing.T) {
+	var attempts int
+	var written []timeSeries
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("got Authorization %q", r.Header.Get("Authorization"))
+		}
+		if r.Header.Get("Content-Encoding") != "snappy" {
+			t.Errorf("got Content-Encoding %q", r.Header.Get("Content-Encoding"))
+		}
+
+		compressed, _ := io.ReadAll(r.Body)
+		body, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		written = decodeWriteRequest(t, body)
+	}))
+	defer server.Close()
+
+	start := time.UnixMilli(1700000000000)
+	upstream := time.UnixMilli(1700000001000)
+	p := &poll{start: start, discovered: true, rooms: []*roomPoll{{
+		room:  WaitingRoom{EventID: "room1"},
+		start: start,
+		metrics: []*queueitMetric{
+			{exportedMetricName: "queue_it_total_queue_count", waitingRoomID: "room1", value: 42, timestamp: upstream},
+			{exportedMetricName: "queue_it_queue_inflow_count", waitingRoomID: "room1", value: 7},
+		},
+	}}}
+
+	rw := &remoteWriteClient{client: http.DefaultClient, url: server.URL, bearerToken: "token", maxRetries: 1, minBackoff: time.Millisecond}
+	if err := rw.write(context.Background(), zap.NewNop(), pollTimeSeries(p)); err != nil {
+		t.Fatal(err)
+	}
+
+	if attempts != 2 {
+		t.Errorf("got %d attempts, want 2", attempts)
+	}
+
+	want := []timeSeries{
+		{name: "queue_it_up", value: 1, timestamp: start},
+		{name: "queue_it_collector_collect_duration_seconds", value: 0, timestamp: start},
+		{name: "queue_it_total_queue_count", waitingRoomID: "room1", value: 42, timestamp: upstream},
+		{name: "queue_it_queue_inflow_count", waitingRoomID: "room1", value: 7, timestamp: start},
+	}
+	if len(written) != len(want) {
+		t.Fatalf("got %d series, want %d", len(written), len(want))
+	}
+	for i := range want {
+		if written[i] != want[i] {
+			t.Errorf("got series %+v, want %+v", written[i], want[i])
+		}
+	}
+}
+
+func TestWriteRequestCollapsesDuplicates(t *testing.T) {
+	at := time.UnixMilli(1700000000000)
+	req := writeRequest([]timeSeries{
+		{name: "queue_it_total_queue_count", waitingRoomID: "room1", value: 42, timestamp: at.Add(time.Second)},
+		{name: "queue_it_total_queue_count", waitingRoomID: "room1", value: 40, timestamp: at},
+		{name: "queue_it_total_queue_count", waitingRoomID: "room1", value: 43, timestamp: at.Add(time.Second)},
+		{name: "queue_it_total_queue_count", waitingRoomID: "room2", value: 7, timestamp: at},
+	})
+
+	if len(req.Timeseries) != 2 {
+		t.Fatalf("got %d series, want 2", len(req.Timeseries))
+	}
+
+	want := []prompb.Sample{{Value: 40, Timestamp: at.UnixMilli()}, {Value: 43, Timestamp: at.Add(time.Second).UnixMilli()}}
+	got := req.Timeseries[0].Samples
+	if len(got) != len(want) {
+		t.Fatalf("got samples %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i].Value != want[i].Value || got[i].Timestamp != want[i].Timestamp {
+			t.Errorf("got sample %v, want %v", got[i], want[i])
+		}
+	}
+}
+
+func TestRemoteWriteClientError(t *testing.T) {
+	var attempts int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	rw := &remoteWriteClient{client: http.DefaultClient, url: server.URL, maxRetries: 3, minBackoff: time.Millisecond}
+	if err := rw.write(context.Background(), zap.NewNop(), nil); err == nil {
+		t.Error("expected an error")
+	}
+
+	if attempts != 1 {
+		t.Errorf("got %d attempts, 4xx must not be retried", attempts)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// roomSetting is a numeric waiting room setting exported as a gauge
+type roomSetting struct {
+	field string
+	// snake_cased field, the field label of queue_it_waiting_room_config_changes_total
+	label              string
+	exportedMetricName string
+	description        string
+	value              func(c *WaitingRoomConfig) float64
+}
+
+// roomInfoSetting is a waiting room setting exported as a label of queue_it_waiting_room_config_info
+type roomInfoSetting struct {
+	field string
+	label string
+	value func(c *WaitingRoomConfig) string
+}
+
+// boolValue exports a boolean as 0 or 1
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+
+	return 0
+}
+
+// roomSettings are the numeric settings of a waiting room configuration
+var roomSettings = []*roomSetting{
+	{
+		field:              "MaxRedirectsPerMinute",
+		label:              "max_redirects_per_minute",
+		exportedMetricName: "queue_it_waiting_room_config_max_redirects_per_minute",
+		description:        "Configured maximum outflow of the waiting room, in users redirected per minute",
+		value:              func(c *WaitingRoomConfig) float64 { return float64(c.MaxRedirectsPerMinute) },
+	},
+	{
+		field:              "MaxNoOfRedirectsPerQueueId",
+		label:              "max_redirects_per_queue_id",
+		exportedMetricName: "queue_it_waiting_room_config_max_redirects_per_queue_id",
+		description:        "Configured maximum number of redirects of a single queue ID",
+		value:              func(c *WaitingRoomConfig) float64 { return float64(c.MaxNoOfRedirectsPerQueueId) },
+	},
+	{
+		field:              "QueueNumberValidityInMinutes",
+		label:              "queue_number_validity_minutes",
+		exportedMetricName: "queue_it_waiting_room_config_queue_number_validity_minutes",
+		description:        "Configured time a queue ID can be reused after being redirected, in minutes",
+		value:              func(c *WaitingRoomConfig) float64 { return float64(c.QueueNumberValidityInMinutes) },
+	},
+	{
+		field:              "JavaScriptSupportEnabled",
+		label:              "javascript_support_enabled",
+		exportedMetricName: "queue_it_waiting_room_config_javascript_support_enabled",
+		description:        "Whether JavaScript support is enabled for the waiting room",
+		value:              func(c *WaitingRoomConfig) float64 { return boolValue(bool(c.JavaScriptSupportEnabled)) },
+	},
+	{
+		field:              "TargetUrlSupportEnabled",
+		label:              "target_url_support_enabled",
+		exportedMetricName: "queue_it_waiting_room_config_target_url_support_enabled",
+		description:        "Whether users may be redirected to a target URL other than the configured one",
+		value:              func(c *WaitingRoomConfig) float64 { return boolValue(bool(c.TargetUrlSupportEnabled)) },
+	},
+}
+
+// roomInfoSettings are the non-numeric settings of a waiting room configuration
+var roomInfoSettings = []*roomInfoSetting{
+	{field: "TargetUrl", label: "target_url", value: func(c *WaitingRoomConfig) string { return c.TargetUrl }},
+	{field: "SafetyNetMode", label: "safety_net_mode", value: func(c *WaitingRoomConfig) string { return c.SafetyNetMode }},
+	{field: "AfterEventLogic", label: "after_event_logic", value: func(c *WaitingRoomConfig) string { return c.AfterEventLogic }},
+	{field: "IdleQueueLogic", label: "idle_queue_logic", value: func(c *WaitingRoomConfig) string { return c.IdleQueueLogic }},
+	{field: "CustomLayout", label: "custom_layout", value: func(c *WaitingRoomConfig) string { return c.CustomLayout }},
+	{field: "Language", label: "language", value: func(c *WaitingRoomConfig) string { return c.Language }},
+}
+
+var (
+	roomConfigInfoDefinition = newRoomConfigInfoDefinition()
+	roomConfigInfo           = roomConfigInfoDefinition.desc()
+)
+
+// newRoomConfigInfoDefinition returns the definition of queue_it_waiting_room_config_info
+func newRoomConfigInfoDefinition() *metricDefinition {
+	labels := []string{"waiting_room_id"}
+	for _, s := range roomInfoSettings {
+		labels = append(labels, s.label)
+	}
+
+	return &metricDefinition{
+		name:   "queue_it_waiting_room_config_info",
+		help:   "A metric with a constant '1' value labeled by the non-numeric configuration settings of the waiting room.",
+		labels: labels,
+	}
+}
+
+// roomConfigMetrics returns the metrics exporting the configuration of a waiting room
+func roomConfigMetrics(c *WaitingRoomConfig, waitingRoomID string) []prometheus.Metric {
+	metrics := make([]prometheus.Metric, 0, len(roomSettings)+1)
+
+	for _, s := range roomSettings {
+		metrics = append(metrics, prometheus.MustNewConstMetric(
+			roomMetricDefinition(s.exportedMetricName, s.description).desc(),
+			prometheus.GaugeValue,
+			s.value(c),
+			waitingRoomID,
+		))
+	}
+
+	values := []string{waitingRoomID}
+	for _, s := range roomInfoSettings {
+		values = append(values, s.value(c))
+	}
+	metrics = append(metrics, prometheus.MustNewConstMetric(roomConfigInfo, prometheus.GaugeValue, 1, values...))
+
+	return metrics
+}
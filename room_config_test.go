@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+func TestGetWaitingRoomConfig(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/2_0/event/drop":
+			w.Write([]byte(`{"EventId": "drop", "TargetUrl": "https://shop.example.com", "MaxRedirectsPerMinute": "300", "MaxNoOfRedirectsPerQueueId": 2, "QueueNumberValidityInMinutes": "30", "JavaScriptSupportEnabled": "True", "Language": "en-US"}`))
+		default:
+			w.Write([]byte(`{"ErrorCode": 404, "ErrorText": "Event not found", "HttpStatusCode": 404}`))
+		}
+	}))
+	defer server.Close()
+
+	q := newQueueitAPI(context.Background(), zap.NewNop(), http.DefaultClient, server.URL, "a-b-c", true)
+
+	config, err := q.getWaitingRoomConfig(context.Background(), "drop")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `
+# HELP queue_it_waiting_room_config_info A metric with a constant '1' value labeled by the non-numeric configuration settings of the waiting room.
+# TYPE queue_it_waiting_room_config_info gauge
+queue_it_waiting_room_config_info{after_event_logic="",custom_layout="",idle_queue_logic="",language="en-US",safety_net_mode="",target_url="https://shop.example.com",waiting_room_id="drop"} 1
+# HELP queue_it_waiting_room_config_javascript_support_enabled Whether JavaScript support is enabled for the waiting room
+# TYPE queue_it_waiting_room_config_javascript_support_enabled gauge
+queue_it_waiting_room_config_javascript_support_enabled{waiting_room_id="drop"} 1
+# HELP queue_it_waiting_room_config_max_redirects_per_minute Configured maximum outflow of the waiting room, in users redirected per minute
+# TYPE queue_it_waiting_room_config_max_redirects_per_minute gauge
+queue_it_waiting_room_config_max_redirects_per_minute{waiting_room_id="drop"} 300
+# HELP queue_it_waiting_room_config_max_redirects_per_queue_id Configured maximum number of redirects of a single queue ID
+# TYPE queue_it_waiting_room_config_max_redirects_per_queue_id gauge
+queue_it_waiting_room_config_max_redirects_per_queue_id{waiting_room_id="drop"} 2
+# HELP queue_it_waiting_room_config_queue_number_validity_minutes Configured time a queue ID can be reused after being redirected, in minutes
+# TYPE queue_it_waiting_room_config_queue_number_validity_minutes gauge
+queue_it_waiting_room_config_queue_number_validity_minutes{waiting_room_id="drop"} 30
+# HELP queue_it_waiting_room_config_target_url_support_enabled Whether users may be redirected to a target URL other than the configured one
+# TYPE queue_it_waiting_room_config_target_url_support_enabled gauge
+queue_it_waiting_room_config_target_url_support_enabled{waiting_room_id="drop"} 0
+`
+	if err := testutil.CollectAndCompare(staticCollector(roomConfigMetrics(config, "drop")), strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := q.getWaitingRoomConfig(context.Background(), "missing"); err == nil {
+		t.Error("expected a Queue-it error for an unknown waiting room")
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+// rulesConfig holds the thresholds of the generated rules
+type rulesConfig struct {
+	downFor            time.Duration
+	stuckFor           time.Duration
+	outflowUtilization float64
+	outflowFor         time.Duration
+	abandonment        float64
+	abandonmentWindow  time.Duration
+	abandonmentFor     time.Duration
+	slowCollection     time.Duration
+	startingSoon       time.Duration
+}
+
+// registerFlags adds the rules threshold flags to a flag set
+func (c *rulesConfig) registerFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&c.downFor, "down-for", 5*time.Minute, "How long the exporter or Queue-it must be unreachable before alerting")
+	fs.DurationVar(&c.stuckFor, "stuck-for", 10*time.Minute, "How long users must wait without any outflow before a waiting room is considered stuck")
+	fs.Float64Var(&c.outflowUtilization, "outflow-utilization", 0.8, "Alert when users wait and the outflow is below this ratio of the maximum outflow")
+	fs.DurationVar(&c.outflowFor, "outflow-for", 15*time.Minute, "How long the outflow must stay below -outflow-utilization before alerting")
+	fs.Float64Var(&c.abandonment, "abandonment", 0.2, "Alert when the ratio of users leaving the queue to users joining it exceeds this value")
+	fs.DurationVar(&c.abandonmentWindow, "abandonment-window", 15*time.Minute, "Window over which abandonment is computed")
+	fs.DurationVar(&c.abandonmentFor, "abandonment-for", 10*time.Minute, "How long abandonment must stay above -abandonment before alerting")
+	fs.DurationVar(&c.slowCollection, "slow-collection", 30*time.Second, "Alert when a collection of Queue-it metrics takes longer than this")
+	fs.DurationVar(&c.startingSoon, "starting-soon", 15*time.Minute, "Alert when the event of a waiting room starts within this duration")
+}
+
+// ruleFile is a Prometheus rule file
+type ruleFile struct {
+	Groups []ruleGroup `yaml:"groups"`
+}
+
+// ruleGroup is a group of a Prometheus rule file
+type ruleGroup struct {
+	Name  string `yaml:"name"`
+	Rules []rule `yaml:"rules"`
+}
+
+// rule is a Prometheus alerting or recording rule
+type rule struct {
+	Record      string            `yaml:"record,omitempty"`
+	Alert       string            `yaml:"alert,omitempty"`
+	Expr        string            `yaml:"expr"`
+	For         model.Duration    `yaml:"for,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+// rules returns the recording and alerting rules for the exporter's metrics
+func (c *rulesConfig) rules() *ruleFile {
+	var (
+		up          = mustMetric("queue_it_up")
+		duration    = mustMetric("queue_it_collector_collect_duration_seconds")
+		waiting     = mustMetric("queue_it_total_waiting_in_queue_count")
+		outflow     = mustMetric("queue_it_queue_outflow_count")
+		inflow      = mustMetric("queue_it_queue_inflow_count")
+		utilization = mustMetric("queue_it_max_outflow_utilization_ratio")
+		drainTime   = mustMetric("queue_it_estimated_drain_time_seconds")
+		left        = mustMetric("queue_it_total_left_queue_count")
+		joined      = mustMetric("queue_it_total_queue_count")
+		maxOutflow  = mustMetric("queue_it_waiting_room_config_max_redirects_per_minute")
+		untilStart  = mustMetric("queue_it_waiting_room_seconds_until_start")
+	)
+
+	abandonmentWindow := model.Duration(c.abandonmentWindow).String()
+
+	return &ruleFile{Groups: []ruleGroup{
+		{
+			Name: "queue-it-exporter.recording",
+			Rules: []rule{
+				{Record: "queue_it:total_waiting_in_queue_count:sum", Expr: fmt.Sprintf("sum(%s)", waiting)},
+				{Record: "queue_it:queue_inflow_count:sum", Expr: fmt.Sprintf("sum(%s)", inflow)},
+				{Record: "queue_it:queue_outflow_count:sum", Expr: fmt.Sprintf("sum(%s)", outflow)},
+				{Record: "queue_it:estimated_drain_time_seconds:max", Expr: fmt.Sprintf("max(%s)", drainTime)},
+				{
+					Record: "queue_it:abandonment_ratio:" + abandonmentWindow,
+					Expr:   fmt.Sprintf("delta(%s[%s]) / clamp_min(delta(%s[%s]), 1)", left, abandonmentWindow, joined, abandonmentWindow),
+				},
+			},
+		},
+		{
+			Name: "queue-it-exporter.alerts",
+			Rules: []rule{
+				{
+					Alert:  "QueueItExporterDown",
+					Expr:   fmt.Sprintf("absent(%s)", up),
+					For:    model.Duration(c.downFor),
+					Labels: map[string]string{"severity": "critical"},
+					Annotations: map[string]string{
+						"summary":     "Queue-it exporter is down",
+						"description": "No Queue-it exporter has been scraped for " + model.Duration(c.downFor).String() + ".",
+					},
+				},
+				{
+					Alert:  "QueueItAPIUnreachable",
+					Expr:   fmt.Sprintf("%s == 0", up),
+					For:    model.Duration(c.downFor),
+					Labels: map[string]string{"severity": "critical"},
+					Annotations: map[string]string{
+						"summary":     "Queue-it API is unreachable",
+						"description": "The Queue-it exporter on {{ $labels.instance }} failed to collect metrics from the Queue-it API.",
+					},
+				},
+				{
+					Alert:  "QueueItCollectionSlow",
+					Expr:   fmt.Sprintf("%s > %g", duration, c.slowCollection.Seconds()),
+					For:    model.Duration(c.downFor),
+					Labels: map[string]string{"severity": "warning"},
+					Annotations: map[string]string{
+						"summary":     "Queue-it collections are slow",
+						"description": "Collecting Queue-it metrics on {{ $labels.instance }} takes {{ $value | humanizeDuration }}.",
+					},
+				},
+				{
+					Alert:  "QueueItWaitingRoomStuck",
+					Expr:   fmt.Sprintf("%s > 0 and on (waiting_room_id) %s == 0", waiting, outflow),
+					For:    model.Duration(c.stuckFor),
+					Labels: map[string]string{"severity": "critical"},
+					Annotations: map[string]string{
+						"summary":     "Queue-it waiting room is stuck",
+						"description": "{{ $value }} users wait in waiting room {{ $labels.waiting_room_id }} and nobody was redirected for " + model.Duration(c.stuckFor).String() + ".",
+					},
+				},
+				{
+					Alert:  "QueueItOutflowBelowMax",
+					Expr:   fmt.Sprintf("%s < %g and on (waiting_room_id) %s > 0", utilization, c.outflowUtilization, waiting),
+					For:    model.Duration(c.outflowFor),
+					Labels: map[string]string{"severity": "warning"},
+					Annotations: map[string]string{
+						"summary":     "Queue-it outflow is below the maximum outflow",
+						"description": "Waiting room {{ $labels.waiting_room_id }} redirects {{ $value | humanizePercentage }} of its maximum outflow while users are waiting.",
+					},
+				},
+				{
+					Alert:  "QueueItMaxOutflowChanged",
+					Expr:   fmt.Sprintf("changes(%s[10m]) > 0", maxOutflow),
+					Labels: map[string]string{"severity": "info"},
+					Annotations: map[string]string{
+						"summary":     "Queue-it max outflow was changed",
+						"description": "The configured max outflow of waiting room {{ $labels.waiting_room_id }} changed over the last 10m.",
+					},
+				},
+				{
+					Alert:  "QueueItWaitingRoomStartingSoon",
+					Expr:   fmt.Sprintf("%s > 0 and %s <= %g", untilStart, untilStart, c.startingSoon.Seconds()),
+					Labels: map[string]string{"severity": "info"},
+					Annotations: map[string]string{
+						"summary":     "Queue-it waiting room event starts soon",
+						"description": "The event of waiting room {{ $labels.waiting_room_id }} starts in {{ $value | humanizeDuration }}.",
+					},
+				},
+				{
+					Alert:  "QueueItHighAbandonment",
+					Expr:   fmt.Sprintf("queue_it:abandonment_ratio:%s > %g", abandonmentWindow, c.abandonment),
+					For:    model.Duration(c.abandonmentFor),
+					Labels: map[string]string{"severity": "warning"},
+					Annotations: map[string]string{
+						"summary":     "Many users leave the Queue-it queue",
+						"description": "{{ $value | humanizePercentage }} of the users joining waiting room {{ $labels.waiting_room_id }} left the queue over the last " + abandonmentWindow + ".",
+					},
+				},
+			},
+		},
+	}}
+}
+
+// writeRules writes the rules as a Prometheus rule file
+func (c *rulesConfig) writeRules(w io.Writer) error {
+	content, err := yaml.Marshal(c.rules())
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(content)
+	return err
+}
+
+// runRules prints Prometheus recording and alerting rules for the exporter's metrics
+func runRules(args []string) int {
+	var cfg rulesConfig
+
+	fs := flag.NewFlagSet("rules", flag.ExitOnError)
+	cfg.registerFlags(fs)
+	fs.Parse(args)
+
+	return exitCode(cfg.writeRules(os.Stdout))
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/rulefmt"
+)
+
+// TestRulesParse checks the generated rules the way promtool check rules does
+func TestRulesParse(t *testing.T) {
+	var cfg rulesConfig
+	fs := flag.NewFlagSet("rules", flag.ContinueOnError)
+	cfg.registerFlags(fs)
+	if err := fs.Parse([]string{"-abandonment-window=30m"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := cfg.writeRules(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	groups, errs := rulefmt.Parse(buf.Bytes())
+	for _, err := range errs {
+		t.Error(err)
+	}
+	if groups == nil {
+		t.Fatal("no rule groups parsed")
+	}
+
+	alerts := map[string]rulefmt.RuleNode{}
+	for _, g := range groups.Groups {
+		for _, r := range g.Rules {
+			if r.Alert.Value != "" {
+				alerts[r.Alert.Value] = r
+			}
+		}
+	}
+
+	for _, name := range []string{"QueueItExporterDown", "QueueItWaitingRoomStuck", "QueueItOutflowBelowMax", "QueueItHighAbandonment", "QueueItWaitingRoomStartingSoon"} {
+		if _, ok := alerts[name]; !ok {
+			t.Errorf("missing %s alert", name)
+		}
+	}
+
+	if expr := alerts["QueueItHighAbandonment"].Expr.Value; !strings.Contains(expr, "abandonment_ratio:30m > 0.2") {
+		t.Errorf("got abandonment expression %q", expr)
+	}
+}
+
+func TestMustMetricUnknown(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic for an unknown metric")
+		}
+	}()
+
+	mustMetric("queue_it_unknown")
+}
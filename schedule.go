@@ -0,0 +1,251 @@
+package main
+
+import (
+	"flag"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Polling tiers, the queue and prequeue tiers are named after their phase
+const (
+	TIER_QUEUE    = "queue"
+	TIER_PREQUEUE = "prequeue"
+	TIER_IDLE     = "idle"
+	TIER_EVENT    = "event"
+	// rooms outside of their event window are discovered but never polled
+	TIER_DISCOVERY_ONLY = "discovery_only"
+)
+
+var (
+	roomPollIntervalDefinition = &metricDefinition{
+		name:   "queue_it_waiting_room_poll_interval_seconds",
+		help:   "Minimum interval between two polls of the statistics of a waiting room, labeled by its polling tier.",
+		labels: []string{"waiting_room_id", "tier"},
+	}
+	roomPollInterval = roomPollIntervalDefinition.desc()
+)
+
+// pollingConfig holds the per-phase polling flags
+type pollingConfig struct {
+	queueInterval    time.Duration
+	prequeueInterval time.Duration
+	idleInterval     time.Duration
+	eventWindow      bool
+	eventGrace       time.Duration
+}
+
+// registerFlags adds the polling flags to a flag set
+func (c *pollingConfig) registerFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&c.queueInterval, "polling.queue-interval", 0, "Minimum interval between two polls of a waiting room queueing users, 0 polls it on every collection")
+	fs.DurationVar(&c.prequeueInterval, "polling.prequeue-interval", 0, "Minimum interval between two polls of a waiting room in the prequeue phase, 0 polls it on every collection")
+	fs.DurationVar(&c.idleInterval, "polling.idle-interval", 0, "Minimum interval between two polls of a waiting room without any user waiting, 0 polls it on every collection")
+	fs.BoolVar(&c.eventWindow, "polling.event-window", false, "Poll the statistics of waiting rooms with an event start time only from their pre-queue start until polling.event-grace after their end, at polling.queue-interval. Idle rooms with an upcoming event start time and postqueue rooms within their grace are discovered too")
+	fs.DurationVar(&c.eventGrace, "polling.event-grace", 30*time.Minute, "How long the statistics of a waiting room are still polled after its event end time with polling.event-window")
+}
+
+// newSchedule returns a pollSchedule. It returns a nil schedule when every
+// room is polled on every collection
+func (c *pollingConfig) newSchedule() *pollSchedule {
+	if c.queueInterval <= 0 && c.prequeueInterval <= 0 && c.idleInterval <= 0 && !c.eventWindow {
+		return nil
+	}
+
+	return &pollSchedule{
+		intervals: map[string]time.Duration{
+			TIER_QUEUE:    c.queueInterval,
+			TIER_PREQUEUE: c.prequeueInterval,
+			TIER_IDLE:     c.idleInterval,
+			TIER_EVENT:    c.queueInterval,
+		},
+		eventWindow: c.eventWindow,
+		eventGrace:  c.eventGrace,
+		now:         time.Now,
+		rooms:       make(map[string]*scheduledRoom),
+	}
+}
+
+// pollSchedule decides which waiting rooms are polled by a collection, the
+// others keep the outcome of their last poll
+type pollSchedule struct {
+	intervals   map[string]time.Duration
+	eventWindow bool
+	eventGrace  time.Duration
+	now         func() time.Time
+
+	mu sync.Mutex
+	// last poll of every discovered waiting room
+	rooms map[string]*scheduledRoom
+}
+
+// scheduledRoom is the last poll of a waiting room
+type scheduledRoom struct {
+	poll *roomPoll
+	at   time.Time
+}
+
+// tier returns the polling tier of a polled waiting room. With event windows,
+// rooms are polled fast within theirs and not at all outside of it. Otherwise
+// rooms without any user waiting are idle, except in the prequeue phase whose
+// visitors are counted by TotalQueueCountBeforeStart instead
+func (s *pollSchedule) tier(r *roomPoll) string {
+	if s.eventWindow {
+		if in, ok := s.inEventWindow(r.room); ok {
+			if in {
+				return TIER_EVENT
+			}
+			return TIER_DISCOVERY_ONLY
+		}
+	}
+
+	if strings.EqualFold(r.room.Phase, TIER_PREQUEUE) {
+		return TIER_PREQUEUE
+	}
+
+	for _, m := range r.metrics {
+		if m.queueitMetricName == "TotalWaitingInQueueCount" && m.err == nil && m.value == 0 {
+			return TIER_IDLE
+		}
+	}
+
+	return TIER_QUEUE
+}
+
+// inEventWindow reports whether a waiting room is between its pre-queue start
+// and eventGrace after its end. ok is false for rooms without a start time;
+// rooms without an end time stay in their window once it opened
+func (s *pollSchedule) inEventWindow(room WaitingRoom) (in bool, ok bool) {
+	if room.EventStartTime.IsZero() {
+		return false, false
+	}
+
+	now := s.now()
+	opens := room.EventStartTime.Add(-time.Duration(room.PreQueueStartsMinuesBefore) * time.Minute)
+	if now.Before(opens) {
+		return false, true
+	}
+
+	if room.EventEndTime.IsZero() {
+		return true, true
+	}
+
+	return !now.After(room.EventEndTime.Add(s.eventGrace)), true
+}
+
+// searchedPhases returns the phases of the waiting rooms to discover. With
+// event windows idle rooms are searched too, so rooms are discovered before
+// their pre-queue opens, and postqueue rooms are searched until their grace
+// ends
+func (s *pollSchedule) searchedPhases() string {
+	if s.eventWindow {
+		return "idle, prequeue, queue, postqueue"
+	}
+
+	return "prequeue, queue"
+}
+
+// dropUnscheduled drops the idle waiting rooms discovered for their event
+// window that have no upcoming event start time, and the postqueue ones whose
+// grace after their event end time is over
+func (s *pollSchedule) dropUnscheduled(rooms []WaitingRoom) []WaitingRoom {
+	if !s.eventWindow {
+		return rooms
+	}
+
+	now := s.now()
+	result := make([]WaitingRoom, 0, len(rooms))
+	for _, room := range rooms {
+		if strings.EqualFold(room.Phase, "idle") && !room.EventStartTime.After(now) {
+			continue
+		}
+		if strings.EqualFold(room.Phase, "postqueue") && (room.EventEndTime.IsZero() || now.After(room.EventEndTime.Add(s.eventGrace))) {
+			continue
+		}
+		result = append(result, room)
+	}
+
+	return result
+}
+
+// skip returns the poll standing for a waiting room that is not due for a new
+// one, nil otherwise. Rooms outside of their event window get a poll without
+// any statistic. Other rooms keep their last poll, and are due once the
+// interval of their tier elapsed, when their phase changed or when a
+// statistic of their last poll failed
+func (s *pollSchedule) skip(room WaitingRoom) *roomPoll {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.eventWindow {
+		if in, ok := s.inEventWindow(room); ok && !in {
+			r := &roomPoll{room: room, start: s.now()}
+			s.rooms[room.EventID] = &scheduledRoom{poll: r, at: r.start}
+			return r
+		}
+	}
+
+	last, ok := s.rooms[room.EventID]
+	// a poll without statistics is never reused, e.g. once the window opens
+	if !ok || len(last.poll.metrics) == 0 || last.poll.room.Phase != room.Phase || last.poll.failed() > 0 {
+		return nil
+	}
+
+	if s.now().Sub(last.at) >= s.intervals[s.tier(last.poll)] {
+		return nil
+	}
+
+	// the room itself is as discovered, its statistics keep their poll time
+	r := *last.poll
+	r.room = room
+	r.reused = true
+
+	return &r
+}
+
+// polled records a new poll of a waiting room
+func (s *pollSchedule) polled(r *roomPoll) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rooms[r.room.EventID] = &scheduledRoom{poll: r, at: s.now()}
+}
+
+// retain forgets the waiting rooms that were not discovered
+func (s *pollSchedule) retain(rooms []WaitingRoom) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	discovered := make(map[string]bool, len(rooms))
+	for _, room := range rooms {
+		discovered[room.EventID] = true
+	}
+
+	for id := range s.rooms {
+		if !discovered[id] {
+			delete(s.rooms, id)
+		}
+	}
+}
+
+// Describe implements Collector
+func (s *pollSchedule) Describe(ch chan<- *prometheus.Desc) {
+	ch <- roomPollInterval
+}
+
+// Collect implements Collector
+func (s *pollSchedule) Collect(ch chan<- prometheus.Metric) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, r := range s.rooms {
+		t := s.tier(r.poll)
+		interval := s.intervals[t].Seconds()
+		if t == TIER_DISCOVERY_ONLY {
+			interval = math.Inf(1)
+		}
+		ch <- prometheus.MustNewConstMetric(roomPollInterval, prometheus.GaugeValue, interval, id, t)
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"go.uber.org/zap"
+)
+
+func TestPollSchedule(t *testing.T) {
+	waiting := map[string]int{"drop": 500000, "pre": 10, "empty": 0}
+
+	var mu sync.Mutex
+	summaries := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/2_0/event/"), "/queue/statistics/summary"); ok {
+			mu.Lock()
+			summaries[id]++
+			mu.Unlock()
+			fmt.Fprintf(w, `{"TotalWaitingInQueueCount": "%d"}`, waiting[id])
+			return
+		}
+		w.Write([]byte(`{"Entries": [{"Sum": "1"}]}`))
+	}))
+	defer server.Close()
+
+	q := newQueueitAPI(context.Background(), zap.NewNop(), http.DefaultClient, server.URL, "a-b-c", true)
+	q.fetchRoomConfig = false
+	q.schedule = (&pollingConfig{queueInterval: 30 * time.Second, prequeueInterval: 2 * time.Minute, idleInterval: 10 * time.Minute}).newSchedule()
+
+	var offset time.Duration
+	q.schedule.now = func() time.Time { return time.Now().Add(offset) }
+
+	rooms := []WaitingRoom{
+		{EventID: "drop", Phase: "queue"},
+		{EventID: "pre", Phase: "prequeue"},
+		{EventID: "empty", Phase: "queue"},
+	}
+
+	steps := []struct {
+		name  string
+		after time.Duration
+		setup func()
+		want  map[string]int
+	}{
+		{name: "first poll", want: map[string]int{"drop": 1, "pre": 1, "empty": 1}},
+		{name: "queue tier due", after: 45 * time.Second, want: map[string]int{"drop": 2, "pre": 1, "empty": 1}},
+		{name: "nothing due", after: 10 * time.Second, want: map[string]int{"drop": 2, "pre": 1, "empty": 1}},
+		{name: "prequeue tier due", after: 2 * time.Minute, want: map[string]int{"drop": 3, "pre": 2, "empty": 1}},
+		{name: "phase change", setup: func() { rooms[1].Phase = "queue" }, want: map[string]int{"drop": 3, "pre": 3, "empty": 1}},
+		{name: "idle tier due", after: 10 * time.Minute, want: map[string]int{"drop": 4, "pre": 4, "empty": 2}},
+	}
+
+	for _, s := range steps {
+		offset += s.after
+		if s.setup != nil {
+			s.setup()
+		}
+
+		polls := q.pollWaitingRooms(context.Background(), rooms)
+		if len(polls) != len(rooms) || polls[1].room.Phase != rooms[1].Phase {
+			t.Fatalf("%s: got polls %v", s.name, polls)
+		}
+
+		mu.Lock()
+		for id, want := range s.want {
+			if summaries[id] != want {
+				t.Errorf("%s: got %d polls of %s, want %d", s.name, summaries[id], id, want)
+			}
+		}
+		mu.Unlock()
+	}
+
+	expected := `
+# HELP queue_it_waiting_room_poll_interval_seconds Minimum interval between two polls of the statistics of a waiting room, labeled by its polling tier.
+# TYPE queue_it_waiting_room_poll_interval_seconds gauge
+queue_it_waiting_room_poll_interval_seconds{tier="idle",waiting_room_id="empty"} 600
+queue_it_waiting_room_poll_interval_seconds{tier="queue",waiting_room_id="drop"} 30
+queue_it_waiting_room_poll_interval_seconds{tier="queue",waiting_room_id="pre"} 30
+`
+	if err := testutil.CollectAndCompare(q.schedule, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+
+	// rooms that are no longer discovered are forgotten
+	q.pollWaitingRooms(context.Background(), rooms[:1])
+	if got := testutil.CollectAndCount(q.schedule); got != 1 {
+		t.Errorf("got %d scheduled rooms, want 1", got)
+	}
+}
+
+func TestEventWindowSchedule(t *testing.T) {
+	var mu sync.Mutex
+	summaries := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/2_0/event/"), "/queue/statistics/summary"); ok {
+			mu.Lock()
+			summaries[id]++
+			mu.Unlock()
+			w.Write([]byte(`{"TotalWaitingInQueueCount": "0"}`))
+			return
+		}
+		w.Write([]byte(`{"Entries": [{"Sum": "1"}]}`))
+	}))
+	defer server.Close()
+
+	q := newQueueitAPI(context.Background(), zap.NewNop(), http.DefaultClient, server.URL, "a-b-c", true)
+	q.fetchRoomConfig = false
+	q.schedule = (&pollingConfig{queueInterval: 30 * time.Second, idleInterval: 10 * time.Minute, eventWindow: true, eventGrace: 30 * time.Minute}).newSchedule()
+
+	now := time.Date(2022, 3, 1, 10, 0, 0, 0, time.UTC)
+	q.schedule.now = func() time.Time { return now }
+
+	rooms := []WaitingRoom{
+		// pre-queue starts in 90 minutes
+		{EventID: "later", Phase: "prequeue", PreQueueStartsMinuesBefore: 30, EventStartTime: stringToTime{now.Add(2 * time.Hour)}},
+		{EventID: "soon", Phase: "prequeue", PreQueueStartsMinuesBefore: 30, EventStartTime: stringToTime{now.Add(20 * time.Minute)}},
+		// the grace period ended 30 minutes ago
+		{EventID: "over", Phase: "queue", EventStartTime: stringToTime{now.Add(-3 * time.Hour)}, EventEndTime: stringToTime{now.Add(-time.Hour)}},
+		{EventID: "unknown", Phase: "queue"},
+	}
+
+	steps := []struct {
+		name  string
+		after time.Duration
+		want  map[string]int
+	}{
+		{name: "first poll", want: map[string]int{"later": 0, "soon": 1, "over": 0, "unknown": 1}},
+		{name: "event tier due", after: 45 * time.Second, want: map[string]int{"later": 0, "soon": 2, "over": 0, "unknown": 1}},
+		{name: "window opens", after: 90 * time.Minute, want: map[string]int{"later": 1, "soon": 3, "over": 0, "unknown": 2}},
+	}
+
+	for _, s := range steps {
+		now = now.Add(s.after)
+
+		polls := q.pollWaitingRooms(context.Background(), rooms)
+		if len(polls) != len(rooms) {
+			t.Fatalf("%s: got polls %v", s.name, polls)
+		}
+		// rooms outside of their window are still discovered
+		if polls[2].room.EventID != "over" || len(polls[2].metrics) != 0 {
+			t.Errorf("%s: got poll %v of a room outside of its window", s.name, polls[2])
+		}
+
+		mu.Lock()
+		for id, want := range s.want {
+			if summaries[id] != want {
+				t.Errorf("%s: got %d polls of %s, want %d", s.name, summaries[id], id, want)
+			}
+		}
+		mu.Unlock()
+	}
+
+	expected := `
+# HELP queue_it_waiting_room_poll_interval_seconds Minimum interval between two polls of the statistics of a waiting room, labeled by its polling tier.
+# TYPE queue_it_waiting_room_poll_interval_seconds gauge
+queue_it_waiting_room_poll_interval_seconds{tier="discovery_only",waiting_room_id="over"} +Inf
+queue_it_waiting_room_poll_interval_seconds{tier="event",waiting_room_id="later"} 30
+queue_it_waiting_room_poll_interval_seconds{tier="event",waiting_room_id="soon"} 30
+queue_it_waiting_room_poll_interval_seconds{tier="idle",waiting_room_id="unknown"} 600
+`
+	if err := testutil.CollectAndCompare(q.schedule, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPollScheduleTier(t *testing.T) {
+	s := (&pollingConfig{queueInterval: time.Minute}).newSchedule()
+	room := func(phase string, waiting float64) *roomPoll {
+		return &roomPoll{room: WaitingRoom{EventID: "drop", Phase: phase}, metrics: []*queueitMetric{
+			{queueitMetricName: "TotalWaitingInQueueCount", value: waiting},
+			{queueitMetricName: "TotalQueueCountBeforeStart", value: 500},
+		}}
+	}
+
+	tests := []struct {
+		name string
+		room *roomPoll
+		want string
+	}{
+		{name: "queueing", room: room("queue", 10), want: TIER_QUEUE},
+		{name: "empty queue", room: room("queue", 0), want: TIER_IDLE},
+		// pre-queue visitors are not counted as waiting in the queue
+		{name: "prequeue", room: room("prequeue", 0), want: TIER_PREQUEUE},
+		{name: "prequeue phase case", room: room("PreQueue", 0), want: TIER_PREQUEUE},
+	}
+
+	for _, tt := range tests {
+		if got := s.tier(tt.room); got != tt.want {
+			t.Errorf("%s: got tier %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReusedPollTimestamp(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/queue/statistics/summary") {
+			w.Write([]byte(`{"TotalWaitingInQueueCount": "7"}`))
+			return
+		}
+		w.Write([]byte(`{"Entries": [{"Sum": "1"}]}`))
+	}))
+	defer server.Close()
+
+	q := newQueueitAPI(context.Background(), zap.NewNop(), http.DefaultClient, server.URL, "a-b-c", true)
+	q.schedule = (&pollingConfig{queueInterval: time.Minute}).newSchedule()
+	rooms := []WaitingRoom{{EventID: "drop", Phase: "queue"}}
+
+	first := q.pollWaitingRooms(context.Background(), rooms)
+	reused := q.pollWaitingRooms(context.Background(), rooms)
+	if !reused[0].reused || first[0].reused {
+		t.Fatalf("got reused %v then %v, want only the second poll reused", first[0].reused, reused[0].reused)
+	}
+
+	// an idle interval of 10m is past the 5m Prometheus lookback, reused
+	// statistics must not carry the time of their poll
+	c := newCollector(zap.NewNop(), q, newExporterStatus())
+	for _, tt := range []struct {
+		name  string
+		rooms []*roomPoll
+	}{
+		{name: "fresh poll", rooms: first},
+		{name: "reused poll", rooms: reused},
+	} {
+		ch := make(chan prometheus.Metric)
+		go func() {
+			c.export(&poll{discovered: true, rooms: tt.rooms}, first[0].start.Add(10*time.Minute), ch)
+			close(ch)
+		}()
+
+		found := map[string]bool{}
+		for m := range ch {
+			var metric dto.Metric
+			if err := m.Write(&metric); err != nil {
+				t.Fatal(err)
+			}
+
+			switch desc := m.Desc().String(); {
+			case strings.Contains(desc, `"queue_it_total_waiting_in_queue_count"`):
+				found["statistic"] = true
+				if metric.TimestampMs != nil {
+					t.Errorf("%s: got timestamp %d, want none", tt.name, metric.GetTimestampMs())
+				}
+			case strings.Contains(desc, `"queue_it_waiting_room_last_poll_timestamp_seconds"`):
+				found["last poll"] = true
+				if got, want := metric.GetGauge().GetValue(), float64(first[0].start.UnixNano())/1e9; got != want {
+					t.Errorf("%s: got last poll %v, want %v", tt.name, got, want)
+				}
+			}
+		}
+		if !found["statistic"] || !found["last poll"] {
+			t.Errorf("%s: got %v, want the statistic and its last poll exported", tt.name, found)
+		}
+	}
+}
+
+func TestEventWindowDiscovery(t *testing.T) {
+	start := time.Now().Add(2 * time.Hour).UTC().Truncate(time.Second)
+	ended := time.Now().Add(-10 * time.Minute).UTC().Truncate(time.Second)
+	over := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+
+	var mu sync.Mutex
+	var search string
+	statistics := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/2_0/event/search" {
+			body, _ := io.ReadAll(r.Body)
+			mu.Lock()
+			search = string(body)
+			mu.Unlock()
+			fmt.Fprintf(w, `[
+				{"EventId": "drop", "Phase": "queue"},
+				{"EventId": "launch", "Phase": "Idle", "PreQueueStartsMinuesBefore": "30", "EventStartTime": %q},
+				{"EventId": "unscheduled", "Phase": "idle"},
+				{"EventId": "ended", "Phase": "postqueue", "EventStartTime": %q, "EventEndTime": %q},
+				{"EventId": "over", "Phase": "postqueue", "EventStartTime": %q, "EventEndTime": %q}
+			]`, start.Format(time.RFC3339), over.Format(time.RFC3339), ended.Format(time.RFC3339), over.Add(-time.Hour).Format(time.RFC3339), over.Format(time.RFC3339))
+			return
+		}
+
+		id, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/2_0/event/"), "/")
+		mu.Lock()
+		statistics[id]++
+		mu.Unlock()
+		if strings.HasSuffix(r.URL.Path, "/queue/statistics/summary") {
+			w.Write([]byte(`{"TotalWaitingInQueueCount": "10"}`))
+			return
+		}
+		w.Write([]byte(`{"Entries": [{"Sum": "1"}]}`))
+	}))
+	defer server.Close()
+
+	q := newQueueitAPI(context.Background(), zap.NewNop(), http.DefaultClient, server.URL, "a-b-c", true)
+	q.schedule = (&pollingConfig{queueInterval: 30 * time.Second, eventWindow: true, eventGrace: 30 * time.Minute}).newSchedule()
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(newCollector(zap.NewNop(), q, newExporterStatus()))
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(search, `"idle, prequeue, queue, postqueue"`) {
+		t.Errorf("got search %s, want idle and postqueue rooms searched too", search)
+	}
+
+	until := map[string]float64{}
+	rooms := map[string]bool{}
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			id := ""
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "waiting_room_id" {
+					id = l.GetValue()
+				}
+			}
+			switch f.GetName() {
+			case "queue_it_waiting_room_seconds_until_start":
+				until[id] = m.GetGauge().GetValue()
+			case "queue_it_waiting_room_info":
+				rooms[id] = true
+			}
+		}
+	}
+
+	if !rooms["drop"] || !rooms["launch"] || !rooms["ended"] || rooms["unscheduled"] || rooms["over"] {
+		t.Errorf("got discovered rooms %v, want drop, launch and ended only", rooms)
+	}
+	if got, ok := until["launch"]; !ok || got <= 0 || got > 2*time.Hour.Seconds() {
+		t.Errorf("got seconds until start %v of launch, want up to 2h", until)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if statistics["launch"] != 0 || statistics["drop"] == 0 || statistics["ended"] == 0 {
+		t.Errorf("got statistics requests %v, want none for launch", statistics)
+	}
+}
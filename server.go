@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/exporter-toolkit/web"
+	"go.uber.org/zap"
+	"go.uber.org/zap/exp/zapslog"
+)
+
+const (
+	HEALTHY_PATH = "/-/healthy"
+	READY_PATH   = "/-/ready"
+)
+
+type paths struct {
+	Metrics template.URL
+	Healthz template.URL
+	Healthy template.URL
+	Ready   template.URL
+	Rooms   template.URL
+}
+
+// serverConfig holds the flags of the HTTP server exposing metrics
+type serverConfig struct {
+	listenAddress     string
+	metricsPath       string
+	healthzPath       string
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	shutdownTimeout   time.Duration
+	webConfigFile     string
+	readyMaxPollAge   time.Duration
+}
+
+// registerFlags adds the HTTP server flags to a flag set
+func (c *serverConfig) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.listenAddress, "web.listen-address", ":8000", "Address on which to expose metrics and web interface.")
+	fs.StringVar(&c.metricsPath, "web.telemetry-path", "/metrics", "Path under which to expose metrics.")
+	fs.StringVar(&c.healthzPath, "web.healthcheck-path", "/healthz", "Path under which to run healthchecks")
+	fs.DurationVar(&c.readHeaderTimeout, "web.read-header-timeout", 10*time.Second, "Maximum duration for reading request headers.")
+	fs.DurationVar(&c.readTimeout, "web.read-timeout", 30*time.Second, "Maximum duration for reading an entire request.")
+	fs.DurationVar(&c.writeTimeout, "web.write-timeout", 60*time.Second, "Maximum duration before timing out writes of a response. Must exceed the time a scrape takes.")
+	fs.DurationVar(&c.idleTimeout, "web.idle-timeout", 120*time.Second, "Maximum amount of time to wait for the next request on keep-alive connections.")
+	fs.DurationVar(&c.shutdownTimeout, "web.shutdown-timeout", 30*time.Second, "Maximum duration of the whole shutdown: draining in-flight requests, pushing the last metrics and flushing traces.")
+	fs.StringVar(&c.webConfigFile, "web.config.file", "", "Path to a Prometheus exporter web configuration file enabling TLS or authentication.")
+	fs.DurationVar(&c.readyMaxPollAge, "web.ready-max-poll-age", 5*time.Minute, "Readiness fails when the last successful poll of the Queue-it API is older than this.")
+}
+
+// flagConfig returns the exporter-toolkit configuration serving on listenAddress
+// with the optional web configuration file
+func (c *serverConfig) flagConfig() *web.FlagConfig {
+	systemdSocket := false
+
+	return &web.FlagConfig{
+		WebListenAddresses: &[]string{c.listenAddress},
+		WebSystemdSocket:   &systemdSocket,
+		WebConfigFile:      &c.webConfigFile,
+	}
+}
+
+// newHandler returns the exporter's HTTP routes exposing metrics gathered from
+// gatherer, fs holds the flags shown on the status page
+func newHandler(cfg *serverConfig, fs *flag.FlagSet, gatherer prometheus.Gatherer, status *exporterStatus) *http.ServeMux {
+	mux := http.NewServeMux()
+
+	// Add root path
+	mux.HandleFunc("/", statusPageHandler(&paths{
+		Metrics: template.URL(cfg.metricsPath),
+		Healthz: template.URL(cfg.healthzPath),
+		Healthy: template.URL(HEALTHY_PATH),
+		Ready:   template.URL(READY_PATH),
+		Rooms:   template.URL(API_ROOMS_PATH),
+	}, fs, status))
+
+	// Liveness only tells the process is alive, healthzPath is kept for
+	// backwards compatibility
+	healthy := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(http.StatusText(http.StatusOK)))
+	}
+	mux.HandleFunc(cfg.healthzPath, healthy)
+	mux.HandleFunc(HEALTHY_PATH, healthy)
+
+	// Readiness depends on the Queue-it API being reachable
+	mux.HandleFunc(READY_PATH, func(w http.ResponseWriter, r *http.Request) {
+		readiness := status.readiness(time.Now(), cfg.readyMaxPollAge)
+
+		w.Header().Set("Content-Type", "application/json")
+		if !readiness.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(readiness)
+	})
+
+	// JSON API mirroring the latest poll
+	mux.HandleFunc("GET "+API_ROOMS_PATH, apiRoomsHandler(status))
+	mux.HandleFunc("GET "+API_STATISTICS_PATH, apiStatisticsHandler(status))
+
+	// Handle metrics requests
+	mux.Handle(cfg.metricsPath, promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}))
+
+	return mux
+}
+
+// newServer returns an HTTP server for handler honoring the configured timeouts
+func newServer(cfg *serverConfig, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              cfg.listenAddress,
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.readHeaderTimeout,
+		ReadTimeout:       cfg.readTimeout,
+		WriteTimeout:      cfg.writeTimeout,
+		IdleTimeout:       cfg.idleTimeout,
+	}
+}
+
+// shutdownContext returns a context done web.shutdown-timeout after ctx is
+// done. Every shutdown stage shares it so together they never take longer
+func (c *serverConfig) shutdownContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	shutdownCtx, cancel := context.WithCancel(context.Background())
+
+	var timer *time.Timer
+	var mu sync.Mutex
+	stop := context.AfterFunc(ctx, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		timer = time.AfterFunc(c.shutdownTimeout, cancel)
+	})
+
+	return shutdownCtx, func() {
+		stop()
+		mu.Lock()
+		defer mu.Unlock()
+		if timer != nil {
+			timer.Stop()
+		}
+		cancel()
+	}
+}
+
+// serve runs srv until ctx is done, then stops accepting connections and waits
+// until shutdownCtx is done for in-flight requests to complete.
+// TLS and basic auth are enabled by the web configuration file, which is read
+// again on every new connection so rotated certificates are picked up
+func serve(ctx context.Context, shutdownCtx context.Context, logger *zap.Logger, srv *http.Server, cfg *serverConfig) error {
+	if cfg.webConfigFile != "" {
+		if err := web.Validate(cfg.webConfigFile); err != nil {
+			return fmt.Errorf("invalid web.config.file: %w", err)
+		}
+	}
+
+	errChan := make(chan error, 1)
+	go func() {
+		logger.Info("queue-it exporter is listening", zap.String("address", srv.Addr), zap.String("webConfigFile", cfg.webConfigFile))
+		errChan <- web.ListenAndServe(srv, cfg.flagConfig(), slog.New(zapslog.NewHandler(logger.Core())))
+	}()
+
+	select {
+	case err := <-errChan:
+		return err
+	case <-ctx.Done():
+	}
+
+	logger.Info("queue-it exporter is shutting down", zap.Duration("timeout", cfg.shutdownTimeout))
+
+	// Shutdown returns once every in-flight scrape has been answered
+	return srv.Shutdown(shutdownCtx)
+}
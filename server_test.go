@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestServeWebConfigBasicAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	webConfigFile := filepath.Join(t.TempDir(), "web-config.yml")
+	if err := os.WriteFile(webConfigFile, []byte(fmt.Sprintf("basic_auth_users:\n  prometheus: %s\n", hash)), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// grab a free port for the server to listen on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	l.Close()
+
+	cfg := &serverConfig{listenAddress: address, shutdownTimeout: time.Second, webConfigFile: webConfigFile}
+	srv := newServer(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	shutdownCtx, cancelShutdown := cfg.shutdownContext(ctx)
+	defer cancelShutdown()
+	done := make(chan error, 1)
+	go func() {
+		done <- serve(ctx, shutdownCtx, zap.NewNop(), srv, cfg)
+	}()
+
+	type test struct {
+		user     string
+		password string
+		want     int
+	}
+	tests := []test{
+		{user: "prometheus", password: "secret", want: http.StatusOK},
+		{user: "prometheus", password: "wrong", want: http.StatusUnauthorized},
+		{want: http.StatusUnauthorized},
+	}
+
+	for _, tc := range tests {
+		var resp *http.Response
+		// wait for the server to start listening
+		for i := 0; i < 50; i++ {
+			req, _ := http.NewRequest("GET", "http://"+address+"/metrics", nil)
+			if tc.user != "" {
+				req.SetBasicAuth(tc.user, tc.password)
+			}
+			if resp, err = http.DefaultClient.Do(req); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != tc.want {
+			t.Errorf("user %q: got status %d, want %d", tc.user, resp.StatusCode, tc.want)
+		}
+	}
+
+	http.DefaultClient.CloseIdleConnections()
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("unexpected shutdown error: %v", err)
+	}
+}
+
+func TestShutdownContext(t *testing.T) {
+	cfg := &serverConfig{shutdownTimeout: 50 * time.Millisecond}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	shutdownCtx, cancelShutdown := cfg.shutdownContext(ctx)
+	defer cancelShutdown()
+
+	select {
+	case <-shutdownCtx.Done():
+		t.Fatal("shutdown context done before ctx")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// the deadline starts once ctx is done
+	cancel()
+	start := time.Now()
+	<-shutdownCtx.Done()
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond || elapsed > time.Second {
+		t.Errorf("shutdown context done after %s, want about %s", elapsed, cfg.shutdownTimeout)
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"go.uber.org/zap"
+)
+
+// STATE_VERSION is the version of the state file format
+const STATE_VERSION = 1
+
+// stateConfig holds the state file flag
+type stateConfig struct {
+	file string
+}
+
+// registerFlags adds the state file flag to a flag set
+func (c *stateConfig) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.file, "state.file", "", "Path to a file persisting the last poll, phase history and counters across restarts, nothing is persisted when empty")
+}
+
+// persistedState is the content of the state file
+type persistedState struct {
+	Version int       `json:"version"`
+	SavedAt time.Time `json:"saved_at"`
+	// last successful poll
+	Snapshot *stateSnapshot `json:"snapshot,omitempty"`
+	// phase changes by waiting room ID
+	Phases map[string][]*phaseChange `json:"phases,omitempty"`
+	// samples of every tracked counter by metric name
+	Counters map[string][]*counterSample `json:"counters,omitempty"`
+	// end of the last counted bucket of the flow counters by waiting room ID
+	// and statistic
+	FlowCursors map[string]map[string]time.Time `json:"flow_cursors,omitempty"`
+}
+
+// stateSnapshot is a successful poll
+type stateSnapshot struct {
+	Start    time.Time    `json:"start"`
+	Duration float64      `json:"duration_seconds"`
+	Rooms    []*stateRoom `json:"rooms"`
+}
+
+// stateRoom is a polled waiting room
+type stateRoom struct {
+	Room     WaitingRoom        `json:"room"`
+	Start    time.Time          `json:"start"`
+	Duration float64            `json:"duration_seconds"`
+	Metrics  []*stateMetric     `json:"metrics"`
+	Config   *WaitingRoomConfig `json:"config,omitempty"`
+}
+
+// stateMetric is a statistic of a waiting room
+type stateMetric struct {
+	Name        string     `json:"name"`
+	Statistic   string     `json:"statistic"`
+	Description string     `json:"description"`
+	Value       float64    `json:"value"`
+	Timestamp   *time.Time `json:"timestamp,omitempty"`
+}
+
+// counterSample is the value of a counter series
+type counterSample struct {
+	Labels map[string]string `json:"labels"`
+	Value  float64           `json:"value"`
+}
+
+// newStateSnapshot returns the persisted form of a successful poll
+func newStateSnapshot(p *poll) *stateSnapshot {
+	s := &stateSnapshot{Start: p.start, Duration: p.duration.Seconds(), Rooms: make([]*stateRoom, 0, len(p.rooms))}
+
+	for _, r := range p.rooms {
+		room := &stateRoom{Room: r.room, Start: r.start, Duration: r.duration.Seconds(), Metrics: make([]*stateMetric, 0, len(r.metrics)), Config: r.config}
+		for _, m := range r.metrics {
+			metric := &stateMetric{Name: m.exportedMetricName, Statistic: m.queueitMetricName, Description: m.description, Value: m.value}
+			if !m.timestamp.IsZero() {
+				ts := m.timestamp
+				metric.Timestamp = &ts
+			}
+			room.Metrics = append(room.Metrics, metric)
+		}
+		s.Rooms = append(s.Rooms, room)
+	}
+
+	return s
+}
+
+// poll returns the poll a snapshot was taken from
+func (s *stateSnapshot) poll() *poll {
+	p := &poll{start: s.Start, duration: time.Duration(s.Duration * float64(time.Second)), discovered: true, discoveredAt: s.Start}
+
+	for _, r := range s.Rooms {
+		room := &roomPoll{room: r.Room, start: r.Start, duration: time.Duration(r.Duration * float64(time.Second)), config: r.Config}
+		for _, m := range r.Metrics {
+			metric := &queueitMetric{exportedMetricName: m.Name, queueitMetricName: m.Statistic, description: m.Description, waitingRoomID: r.Room.EventID, value: m.Value}
+			if m.Timestamp != nil {
+				metric.timestamp = *m.Timestamp
+			}
+			room.metrics = append(room.metrics, metric)
+		}
+		p.rooms = append(p.rooms, room)
+	}
+
+	return p
+}
+
+// stateStore persists the exporter status and tracked counters to a file
+type stateStore struct {
+	logger *zap.Logger
+	path   string
+	status *exporterStatus
+
+	mu sync.Mutex
+	// tracked counters by metric name
+	counters map[string]*prometheus.CounterVec
+	// tracked flow counters, nil when not tracked
+	flows *flowCounters
+	// last successful poll
+	snapshot *stateSnapshot
+}
+
+// newStore returns a stateStore persisting to the configured file. It
+// returns a nil store when no file is configured
+func (c *stateConfig) newStore(logger *zap.Logger, status *exporterStatus) *stateStore {
+	if c.file == "" {
+		return nil
+	}
+
+	return &stateStore{
+		logger:   logger,
+		path:     c.file,
+		status:   status,
+		counters: make(map[string]*prometheus.CounterVec),
+	}
+}
+
+// track persists the series of a counter, identified by its metric name
+func (s *stateStore) track(name string, counter *prometheus.CounterVec) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.counters[name] = counter
+}
+
+// trackFlows persists the cursors of flow counters, whose counters must be
+// tracked too. Restored counters then resume after the last counted bucket
+// instead of counting it again
+func (s *stateStore) trackFlows(flows *flowCounters) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.flows = flows
+}
+
+// restore loads the state file, adds the persisted values to the tracked
+// counters and seeds the status. It returns the restored poll, nil when
+// there is no state file yet or it holds no successful poll
+func (s *stateStore) restore() (*poll, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	content, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read file from state.file: %w", err)
+	}
+
+	var state persistedState
+	if err := json.Unmarshal(content, &state); err != nil {
+		return nil, fmt.Errorf("invalid state.file: %w", err)
+	}
+	if state.Version != STATE_VERSION {
+		return nil, fmt.Errorf("unsupported state.file version %d", state.Version)
+	}
+
+	for name, samples := range state.Counters {
+		counter, ok := s.counters[name]
+		if !ok {
+			s.logger.Warn("stateStore.restore(): ignoring unknown counter", zap.String("name", name))
+			continue
+		}
+
+		for _, sample := range samples {
+			c, err := counter.GetMetricWith(sample.Labels)
+			if err != nil {
+				s.logger.Warn("stateStore.restore(): ignoring counter sample", zap.String("name", name), zap.Error(err))
+				continue
+			}
+			c.Add(sample.Value)
+		}
+	}
+
+	if s.flows != nil {
+		s.flows.restoreCursors(state.FlowCursors)
+	}
+
+	var p *poll
+	if state.Snapshot != nil {
+		s.snapshot = state.Snapshot
+		p = state.Snapshot.poll()
+	}
+	s.status.restore(p, state.Phases)
+
+	s.logger.Info("stateStore.restore(): restored state", zap.String("path", s.path), zap.Time("saved_at", state.SavedAt))
+
+	return p, nil
+}
+
+// observe implements pollObserver, saving the state after every poll
+func (s *stateStore) observe(p *poll) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := p.metrics(); err == nil {
+		s.snapshot = newStateSnapshot(p)
+	}
+
+	if err := s.save(); err != nil {
+		s.logger.Warn("stateStore.observe(): failed to save state", zap.String("path", s.path), zap.Error(err))
+	}
+}
+
+// flush saves the state, e.g. on shutdown
+func (s *stateStore) flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.save()
+}
+
+// save atomically replaces the state file with the current state
+func (s *stateStore) save() error {
+	state := &persistedState{
+		Version:  STATE_VERSION,
+		SavedAt:  time.Now(),
+		Snapshot: s.snapshot,
+		Phases:   s.status.phaseHistories(),
+		Counters: make(map[string][]*counterSample, len(s.counters)),
+	}
+
+	for name, counter := range s.counters {
+		samples, err := counterSamples(counter)
+		if err != nil {
+			return err
+		}
+		state.Counters[name] = samples
+	}
+
+	// cursors are read after the counters: a bucket counted in between is
+	// caught up from SumOffset after a restart rather than counted twice
+	if s.flows != nil {
+		state.FlowCursors = s.flows.cursorsSnapshot()
+	}
+
+	content, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file of the same directory and rename it so the
+	// state file is never partially written
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// counterSamples returns the value of every series of a counter
+func counterSamples(counter *prometheus.CounterVec) ([]*counterSample, error) {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		counter.Collect(ch)
+		close(ch)
+	}()
+
+	samples := make([]*counterSample, 0)
+	for m := range ch {
+		var metric dto.Metric
+		if err := m.Write(&metric); err != nil {
+			// drain the channel so Collect returns
+			for range ch {
+			}
+			return nil, err
+		}
+
+		sample := &counterSample{Labels: make(map[string]string, len(metric.Label)), Value: metric.GetCounter().GetValue()}
+		for _, l := range metric.Label {
+			sample.Labels[l.GetName()] = l.GetValue()
+		}
+		samples = append(samples, sample)
+	}
+
+	// keep the file stable between saves
+	sort.Slice(samples, func(i, j int) bool {
+		return fmt.Sprint(samples[i].Labels) < fmt.Sprint(samples[j].Labels)
+	})
+
+	return samples, nil
+}
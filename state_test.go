@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+func newTestCounter() *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "queue_it_test_total",
+		Help: "Test counter.",
+	}, []string{"waiting_room_id"})
+}
+
+func TestStateStore(t *testing.T) {
+	cfg := &stateConfig{file: filepath.Join(t.TempDir(), "state.json")}
+
+	// first run
+	status := newExporterStatus()
+	store := cfg.newStore(zap.NewNop(), status)
+	counter := newTestCounter()
+	store.track("queue_it_test_total", counter)
+
+	if restored, err := store.restore(); err != nil || restored != nil {
+		t.Fatalf("got restored poll %v and error %v without a state file", restored, err)
+	}
+
+	drop := WaitingRoom{EventID: "drop", DisplayName: "Drop", Phase: "running", EventStartTime: stringToTime{time.Date(2022, 3, 1, 10, 0, 0, 0, time.UTC)}}
+	p := newTestPoll([]WaitingRoom{drop}, map[string]float64{"drop": 1200})
+	p.start = time.Unix(1646128800, 0)
+	p.rooms[0].metrics[0].exportedMetricName = "queue_it_total_waiting_in_queue_count"
+	p.rooms[0].config = &WaitingRoomConfig{EventID: "drop", MaxRedirectsPerMinute: 300}
+	status.record(p)
+	store.observe(p)
+
+	// a failed poll keeps the last successful one
+	failed := &poll{start: time.Now(), err: errors.New("queue-it is down")}
+	status.record(failed)
+	store.observe(failed)
+
+	counter.WithLabelValues("drop").Add(3)
+	if err := store.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, _ := os.ReadDir(filepath.Dir(cfg.file))
+	if len(entries) != 1 {
+		t.Errorf("got %d files in the state directory, want only the state file", len(entries))
+	}
+
+	// second run
+	status = newExporterStatus()
+	store = cfg.newStore(zap.NewNop(), status)
+	counter = newTestCounter()
+	store.track("queue_it_test_total", counter)
+
+	restored, err := store.restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := testutil.ToFloat64(counter.WithLabelValues("drop")); got != 3 {
+		t.Errorf("got restored counter %v, want 3", got)
+	}
+
+	if restored == nil || len(restored.rooms) != 1 {
+		t.Fatalf("got restored poll %v", restored)
+	}
+	room := restored.rooms[0]
+	if !room.room.EventStartTime.Equal(drop.EventStartTime.Time) || room.config.MaxRedirectsPerMinute != 300 {
+		t.Errorf("got restored room %+v", room)
+	}
+	metrics, err := restored.metrics()
+	if err != nil || len(metrics) != 1 || metrics[0].value != 1200 || metrics[0].waitingRoomID != "drop" {
+		t.Errorf("got restored metrics %v and error %v", metrics, err)
+	}
+
+	if status.latestPoll() != restored || status.restoredPoll() != restored {
+		t.Error("expected the status to serve the restored poll")
+	}
+	if history := status.phaseHistory("drop"); len(history) != 1 || history[0].Phase != "running" {
+		t.Errorf("got restored phase history %v", history)
+	}
+
+	// the restored poll is served with its poll time until a poll succeeds
+	c := newCollector(zap.NewNop(), newQueueitAPI(context.Background(), zap.NewNop(), http.DefaultClient, "http://127.0.0.1:0", "a-b-c", true), status)
+	if err := testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP queue_it_total_waiting_in_queue_count
+# TYPE queue_it_total_waiting_in_queue_count gauge
+queue_it_total_waiting_in_queue_count{waiting_room_id="drop"} 1200 1646128800000
+# HELP queue_it_up Was talking to Queue-it successful.
+# TYPE queue_it_up gauge
+queue_it_up 0
+`), "queue_it_up", "queue_it_total_waiting_in_queue_count"); err != nil {
+		t.Error(err)
+	}
+
+	drop.Phase = "queue"
+	status.record(newTestPoll([]WaitingRoom{drop}, map[string]float64{"drop": 1000}))
+	if status.restoredPoll() != nil {
+		t.Error("expected a successful poll to replace the restored poll")
+	}
+	if history := status.phaseHistory("drop"); len(history) != 2 || history[1].Phase != "queue" {
+		t.Errorf("got phase history %v", history)
+	}
+}
+
+func TestStateStoreFlowCounters(t *testing.T) {
+	cfg := &stateConfig{file: filepath.Join(t.TempDir(), "state.json")}
+	minute := func(m int) time.Time { return time.Date(2022, 3, 1, 10, m, 0, 0, time.UTC) }
+	outflow := func(sumOffset float64, sums ...float64) *poll {
+		flow := &flowDetail{from: minute(0), sumOffset: sumOffset}
+		for i, sum := range sums {
+			flow.buckets = append(flow.buckets, &flowBucket{start: minute(i), end: minute(i + 1), sum: sum})
+		}
+		return &poll{rooms: []*roomPoll{{metrics: []*queueitMetric{{queueitMetricName: "queueoutflow", waitingRoomID: "drop", flow: flow}}}}}
+	}
+	run := func() (*stateStore, *flowCounters) {
+		store := cfg.newStore(zap.NewNop(), newExporterStatus())
+		flows := newFlowCounters(zap.NewNop())
+		for _, m := range flowCounterMetrics {
+			store.track(m.exportedMetricName, flows.counters[m.queueitMetricName])
+		}
+		store.trackFlows(flows)
+		if _, err := store.restore(); err != nil {
+			t.Fatal(err)
+		}
+		return store, flows
+	}
+
+	// first run
+	store, flows := run()
+	p := outflow(1000, 10, 20)
+	flows.observe(p)
+	store.observe(p)
+
+	// second run, the next window overlaps the buckets counted before the restart
+	_, flows = run()
+	flows.observe(outflow(1000, 10, 20, 5))
+
+	if got := testutil.ToFloat64(flows.counters["queueoutflow"].WithLabelValues("drop")); got != 1000+10+20+5 {
+		t.Errorf("got restored counter %v, want SumOffset plus the bucket sums %v", got, 1000+10+20+5)
+	}
+	if got := testutil.ToFloat64(flows.drift.WithLabelValues("drop", "queueoutflow")); got != 0 {
+		t.Errorf("got drift %v after a restart, want 0", got)
+	}
+}
+
+func TestStateStoreInvalidFile(t *testing.T) {
+	cfg := &stateConfig{file: filepath.Join(t.TempDir(), "state.json")}
+	if err := os.WriteFile(cfg.file, []byte(`{"version": 42}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := cfg.newStore(zap.NewNop(), newExporterStatus()).restore(); err == nil {
+		t.Error("expected an error for an unsupported state file version")
+	}
+}
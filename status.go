@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// exporterStatus tracks the outcome of collections to report readiness
+type exporterStatus struct {
+	mu sync.RWMutex
+	// time of the last successful waiting room discovery
+	lastDiscovery time.Time
+	// time of the last collection that reached Queue-it, even if some of its
+	// statistics failed
+	lastPoll time.Time
+	// error of the last failed collection, cleared by a successful one
+	lastError error
+	// outcome of the last collection
+	latest *poll
+	// last successful poll restored from a state file, cleared by a successful poll
+	restored *poll
+	// phase changes of every waiting room seen, oldest first
+	phases map[string][]*phaseChange
+}
+
+// MAX_PHASE_CHANGES is the number of phase changes kept per waiting room
+const MAX_PHASE_CHANGES = 20
+
+// phaseChange is a waiting room entering a phase
+type phaseChange struct {
+	Phase string    `json:"phase"`
+	Since time.Time `json:"since"`
+}
+
+// readiness is the JSON body served by the readiness endpoint
+type readiness struct {
+	Ready         bool       `json:"ready"`
+	Reasons       []string   `json:"reasons,omitempty"`
+	LastDiscovery *time.Time `json:"last_discovery,omitempty"`
+	LastPoll      *time.Time `json:"last_successful_poll,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+}
+
+// newExporterStatus returns an exporterStatus that has not seen any collection yet
+func newExporterStatus() *exporterStatus {
+	return &exporterStatus{phases: make(map[string][]*phaseChange)}
+}
+
+// record updates the status with the outcome of a poll
+func (s *exporterStatus) record(p *poll) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.latest = p
+
+	if p.discovered {
+		s.lastDiscovery = p.discoveredAt
+	}
+
+	for _, r := range p.rooms {
+		s.recordPhase(r.room.EventID, r.room.Phase, p.start)
+	}
+
+	// a flaky statistic does not make the exporter unready
+	if p.reachedQueueit() {
+		s.lastPoll = p.start
+	}
+
+	if _, err := p.metrics(); err != nil {
+		s.lastError = err
+		return
+	}
+
+	s.lastError = nil
+	s.restored = nil
+}
+
+// recordPhase appends a phase change when a waiting room entered a new phase
+func (s *exporterStatus) recordPhase(id string, phase string, at time.Time) {
+	history := s.phases[id]
+	if len(history) > 0 && history[len(history)-1].Phase == phase {
+		return
+	}
+
+	history = append(history, &phaseChange{Phase: phase, Since: at})
+	if len(history) > MAX_PHASE_CHANGES {
+		history = history[len(history)-MAX_PHASE_CHANGES:]
+	}
+	s.phases[id] = history
+}
+
+// restore seeds a status that has not seen any collection yet with the
+// last successful poll and the phase history of a previous run
+func (s *exporterStatus) restore(p *poll, phases map[string][]*phaseChange) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.latest = p
+	s.restored = p
+	for id, history := range phases {
+		s.phases[id] = history
+	}
+}
+
+// restoredPoll returns the poll restored from a state file until a poll succeeds, nil otherwise
+func (s *exporterStatus) restoredPoll() *poll {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.restored
+}
+
+// phaseHistory returns the phase changes of a waiting room, oldest first
+func (s *exporterStatus) phaseHistory(id string) []*phaseChange {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]*phaseChange(nil), s.phases[id]...)
+}
+
+// phaseHistories returns the phase changes of every waiting room
+func (s *exporterStatus) phaseHistories() map[string][]*phaseChange {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	phases := make(map[string][]*phaseChange, len(s.phases))
+	for id, history := range s.phases {
+		phases[id] = append([]*phaseChange(nil), history...)
+	}
+
+	return phases
+}
+
+// latestPoll returns the outcome of the last poll, nil if none happened yet
+func (s *exporterStatus) latestPoll() *poll {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.latest
+}
+
+// readiness reports whether waiting rooms were discovered and a collection
+// reached Queue-it no longer than maxPollAge ago
+func (s *exporterStatus) readiness(now time.Time, maxPollAge time.Duration) *readiness {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	r := &readiness{Ready: true}
+
+	if s.lastError != nil {
+		r.LastError = s.lastError.Error()
+	}
+
+	if s.lastDiscovery.IsZero() {
+		r.Ready = false
+		r.Reasons = append(r.Reasons, "waiting rooms have not been discovered yet")
+	} else {
+		lastDiscovery := s.lastDiscovery
+		r.LastDiscovery = &lastDiscovery
+	}
+
+	if s.lastPoll.IsZero() {
+		r.Ready = false
+		r.Reasons = append(r.Reasons, "no successful poll yet")
+	} else {
+		lastPoll := s.lastPoll
+		r.LastPoll = &lastPoll
+
+		if age := now.Sub(lastPoll); age > maxPollAge {
+			r.Ready = false
+			r.Reasons = append(r.Reasons, fmt.Sprintf("last successful poll is %s old, more than %s", age.Round(time.Second), maxPollAge))
+		}
+	}
+
+	return r
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"flag"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+// secretFlagWords flags whose name contains one of these words have their
+// value redacted from the status page, unless they point to a file
+var secretFlagWords = []string{"password", "secret", "token", "api-key"}
+
+// configEntry is a flag and its effective value
+type configEntry struct {
+	Name  string
+	Value string
+}
+
+// statusPage is the data rendered by statusTemplate
+type statusPage struct {
+	Version string
+	Paths   *paths
+	Config  []configEntry
+	Poll    *pollView
+}
+
+// pollView is the rendered outcome of the last poll
+type pollView struct {
+	Start    time.Time
+	Duration time.Duration
+	Error    string
+	Rooms    []*roomView
+}
+
+// roomView is the rendered outcome of polling a waiting room
+type roomView struct {
+	ID         string
+	Name       string
+	Phase      string
+	LastPoll   time.Time
+	Duration   time.Duration
+	Failed     int
+	Statistics []*statisticView
+}
+
+// statisticView is a rendered statistic of a waiting room
+type statisticView struct {
+	Name      string
+	Statistic string
+	Value     float64
+	Error     string
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<html>
+	<head>
+		<title>Queue-it Prometheus Exporter</title>
+		<style>
+			body { font-family: sans-serif; }
+			table { border-collapse: collapse; margin-bottom: 1em; }
+			th, td { border: 1px solid #ccc; padding: 2px 8px; text-align: left; }
+			.error { color: #b00; }
+		</style>
+	</head>
+	<body>
+		<h1>Queue-it Prometheus Exporter</h1>
+		<p>Version: {{.Version}}</p>
+		<ul>
+			<li><a href='{{.Paths.Metrics}}'>metrics</a></li>
+			<li><a href='{{.Paths.Healthz}}'>healthz</a></li>
+			<li><a href='{{.Paths.Healthy}}'>healthy</a></li>
+			<li><a href='{{.Paths.Ready}}'>ready</a></li>
+			<li><a href='{{.Paths.Rooms}}'>rooms API</a></li>
+		</ul>
+
+		<h2>Configuration</h2>
+		<table>
+			{{range .Config}}<tr><td>{{.Name}}</td><td>{{.Value}}</td></tr>
+			{{end}}
+		</table>
+
+		<h2>Last poll</h2>
+		{{with .Poll}}
+		<p>Started {{.Start.Format "2006-01-02T15:04:05Z07:00"}}, took {{.Duration}}</p>
+		{{if .Error}}<p class="error">Discovery failed: {{.Error}}</p>{{end}}
+		{{range .Rooms}}
+		<h3>{{.Name}} ({{.ID}})</h3>
+		<p>Phase: {{.Phase}}. Polled {{.LastPoll.Format "2006-01-02T15:04:05Z07:00"}} in {{.Duration}}{{if .Failed}}, <span class="error">{{.Failed}} statistics failed</span>{{end}}</p>
+		<table>
+			<tr><th>metric</th><th>statistic</th><th>value</th><th>status</th></tr>
+			{{range .Statistics}}<tr><td>{{.Name}}</td><td>{{.Statistic}}</td><td>{{.Value}}</td>{{if .Error}}<td class="error">{{.Error}}</td>{{else}}<td>ok</td>{{end}}</tr>
+			{{end}}
+		</table>
+		{{else}}
+		<p>{{if not .Error}}No waiting room discovered{{end}}</p>
+		{{end}}
+		{{else}}
+		<p>No poll yet, polls happen on every scrape</p>
+		{{end}}
+	</body>
+</html>`))
+
+// isSecretFlag reports whether the value of a flag must not be displayed
+func isSecretFlag(name string) bool {
+	name = strings.ToLower(name)
+	if strings.HasSuffix(name, "-path") || strings.HasSuffix(name, "-file") || strings.HasSuffix(name, ".file") {
+		return false
+	}
+
+	for _, word := range secretFlagWords {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// effectiveConfig returns every flag of fs with its value, secrets redacted
+func effectiveConfig(fs *flag.FlagSet) []configEntry {
+	entries := make([]configEntry, 0)
+
+	fs.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if isSecretFlag(f.Name) && value != "" {
+			value = "<redacted>"
+		}
+
+		entries = append(entries, configEntry{Name: f.Name, Value: value})
+	})
+
+	return entries
+}
+
+// newPollView renders a poll, nil if p is nil
+func newPollView(p *poll) *pollView {
+	if p == nil {
+		return nil
+	}
+
+	v := &pollView{Start: p.start, Duration: p.duration}
+	if p.err != nil {
+		v.Error = p.err.Error()
+	}
+
+	for _, r := range p.rooms {
+		room := &roomView{
+			ID:       r.room.EventID,
+			Name:     r.room.DisplayName,
+			Phase:    r.room.Phase,
+			LastPoll: r.start,
+			Duration: r.duration,
+			Failed:   r.failed(),
+		}
+
+		for _, m := range r.metrics {
+			stat := &statisticView{Name: m.exportedMetricName, Statistic: m.queueitMetricName, Value: m.value}
+			if m.err != nil {
+				stat.Error = m.err.Error()
+			}
+
+			room.Statistics = append(room.Statistics, stat)
+		}
+		sort.Slice(room.Statistics, func(i, j int) bool { return room.Statistics[i].Name < room.Statistics[j].Name })
+
+		v.Rooms = append(v.Rooms, room)
+	}
+
+	return v
+}
+
+// statusPageHandler serves an HTML page with the build version, effective
+// configuration and outcome of the last poll
+func statusPageHandler(p *paths, fs *flag.FlagSet, status *exporterStatus) http.HandlerFunc {
+	config := effectiveConfig(fs)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		statusTemplate.Execute(w, &statusPage{
+			Version: version,
+			Paths:   p,
+			Config:  config,
+			Poll:    newPollView(status.latestPoll()),
+		})
+	}
+}
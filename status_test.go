@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"testing"
+	"time"
+)
+
+func TestExporterStatusReadiness(t *testing.T) {
+	now := time.Now()
+
+	type test struct {
+		name    string
+		status  *exporterStatus
+		want    bool
+		reasons int
+	}
+	tests := []test{
+		{name: "never collected", status: &exporterStatus{}, want: false, reasons: 2},
+		{name: "discovery only", status: &exporterStatus{lastDiscovery: now, lastError: errors.New("boom")}, want: false, reasons: 1},
+		{name: "fresh poll", status: &exporterStatus{lastDiscovery: now, lastPoll: now.Add(-time.Minute)}, want: true},
+		{name: "stale poll", status: &exporterStatus{lastDiscovery: now, lastPoll: now.Add(-time.Hour)}, want: false, reasons: 1},
+	}
+
+	for _, tc := range tests {
+		got := tc.status.readiness(now, 5*time.Minute)
+
+		if got.Ready != tc.want || len(got.Reasons) != tc.reasons {
+			t.Errorf("%s: got ready=%t reasons=%v", tc.name, got.Ready, got.Reasons)
+		}
+	}
+}
+
+func TestEffectiveConfigRedactsSecrets(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("config.queue-it-api-key-path", "/secrets/api-key", "")
+	fs.String("push.basic-auth-password", "hunter2", "")
+	fs.String("web.listen-address", ":8000", "")
+
+	want := map[string]string{
+		"config.queue-it-api-key-path": "/secrets/api-key",
+		"push.basic-auth-password":     "<redacted>",
+		"web.listen-address":           ":8000",
+	}
+
+	for _, e := range effectiveConfig(fs) {
+		if want[e.Name] != e.Value {
+			t.Errorf("%s: got %q, want %q", e.Name, e.Value, want[e.Name])
+		}
+	}
+}
+
+func TestExporterStatusPartialFailure(t *testing.T) {
+	status := newExporterStatus()
+	start := time.Now()
+
+	status.record(&poll{start: start, discovered: true, discoveredAt: start, rooms: []*roomPoll{{
+		room: WaitingRoom{EventID: "drop"},
+		metrics: []*queueitMetric{
+			{queueitMetricName: "TotalQueueCount", value: 42},
+			{queueitMetricName: "queueoutflow", err: errors.New("boom")},
+		},
+	}}})
+
+	got := status.readiness(start, 5*time.Minute)
+	if !got.Ready || got.LastPoll == nil || got.LastError == "" {
+		t.Errorf("got readiness %+v after a partially failed poll", got)
+	}
+
+	status.record(&poll{start: start.Add(time.Minute), discovered: true, discoveredAt: start, rooms: []*roomPoll{{
+		room:    WaitingRoom{EventID: "drop"},
+		metrics: []*queueitMetric{{queueitMetricName: "TotalQueueCount", err: errors.New("boom")}},
+	}}})
+	if got := status.readiness(start.Add(time.Minute), 5*time.Minute); !got.LastPoll.Equal(start) {
+		t.Errorf("got last poll %s after a poll where every statistic failed, want %s", got.LastPoll, start)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	OTLP_PROTOCOL_GRPC = "grpc"
+	OTLP_PROTOCOL_HTTP = "http"
+	SERVICE_NAME       = "queue-it-prometheus-exporter"
+)
+
+// Span attributes. There is no retry count: Queue-it requests are sent once
+// per poll and never retried, a failed statistic is fetched again by the next
+// poll, in another trace
+const (
+	ATTRIBUTE_WAITING_ROOM_ID = attribute.Key("queue_it.waiting_room_id")
+	ATTRIBUTE_STATISTIC       = attribute.Key("queue_it.statistic")
+	ATTRIBUTE_ENDPOINT        = attribute.Key("queue_it.endpoint")
+	ATTRIBUTE_ROOM_COUNT      = attribute.Key("queue_it.waiting_room_count")
+)
+
+// tracer uses the global tracer provider, a no-op unless tracing is enabled
+var tracer = otel.Tracer("github.com/dapperlabs-platform/queue-it-prometheus-exporter")
+
+// tracingConfig holds the tracing flags
+type tracingConfig struct {
+	endpoint    string
+	protocol    string
+	insecure    bool
+	sampleRatio float64
+}
+
+// registerFlags adds the tracing flags to a flag set
+func (c *tracingConfig) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.endpoint, "tracing.otlp-endpoint", "", "host:port of an OTLP receiver to export traces to. Tracing is disabled when empty")
+	fs.StringVar(&c.protocol, "tracing.otlp-protocol", OTLP_PROTOCOL_GRPC, "OTLP protocol used to export traces. One of: grpc, http")
+	fs.BoolVar(&c.insecure, "tracing.otlp-insecure", false, "Disable TLS when exporting traces")
+	fs.Float64Var(&c.sampleRatio, "tracing.sample-ratio", 1, "Ratio of collection cycles to trace, between 0 and 1")
+}
+
+// newTracerProvider sets up the global tracer provider exporting spans over
+// OTLP. It returns a nil provider when tracing is disabled
+func (c *tracingConfig) newTracerProvider(ctx context.Context) (*sdktrace.TracerProvider, error) {
+	if c.endpoint == "" {
+		return nil, nil
+	}
+
+	var client otlptrace.Client
+	switch c.protocol {
+	case OTLP_PROTOCOL_GRPC:
+		opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(c.endpoint)}
+		if c.insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		client = otlptracegrpc.NewClient(opts...)
+	case OTLP_PROTOCOL_HTTP:
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(c.endpoint)}
+		if c.insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		client = otlptracehttp.NewClient(opts...)
+	default:
+		return nil, fmt.Errorf("invalid tracing.otlp-protocol %q, must be one of grpc or http", c.protocol)
+	}
+
+	exporter, err := otlptrace.New(ctx, client)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP trace exporter: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(SERVICE_NAME),
+		semconv.ServiceVersion(version),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(c.sampleRatio))),
+	)
+	otel.SetTracerProvider(tp)
+
+	return tp, nil
+}
+
+// spanAttributesKey is the context key holding attributes added to request spans
+type spanAttributesKey struct{}
+
+// withSpanAttributes returns a context adding attrs to the spans of requests made with it
+func withSpanAttributes(ctx context.Context, attrs ...attribute.KeyValue) context.Context {
+	parent, _ := ctx.Value(spanAttributesKey{}).([]attribute.KeyValue)
+
+	merged := make([]attribute.KeyValue, 0, len(parent)+len(attrs))
+	merged = append(merged, parent...)
+	merged = append(merged, attrs...)
+
+	return context.WithValue(ctx, spanAttributesKey{}, merged)
+}
+
+// spanAttributesFromContext returns the attributes set by withSpanAttributes
+func spanAttributesFromContext(ctx context.Context) []attribute.KeyValue {
+	attrs, _ := ctx.Value(spanAttributesKey{}).([]attribute.KeyValue)
+	return attrs
+}
+
+// traceRequests wraps next to record a client span for every request
+func traceRequests(next http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		endpoint := endpointFromContext(req.Context())
+
+		attrs := append([]attribute.KeyValue{
+			semconv.HTTPRequestMethodKey.String(req.Method),
+			semconv.URLPath(req.URL.Path),
+			semconv.ServerAddress(req.URL.Hostname()),
+			ATTRIBUTE_ENDPOINT.String(endpoint),
+		}, spanAttributesFromContext(req.Context())...)
+
+		ctx, span := tracer.Start(req.Context(), "queue-it "+req.Method+" "+endpoint,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(attrs...),
+		)
+		defer span.End()
+
+		resp, err := next.RoundTrip(req.WithContext(ctx))
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return nil, err
+		}
+
+		span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+		if resp.StatusCode >= 400 {
+			span.SetStatus(codes.Error, "HTTP "+strconv.Itoa(resp.StatusCode))
+		}
+
+		return resp, nil
+	})
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+func TestPollSpans(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/2_0/event/search" {
+			w.Write([]byte(`[{"EventId":"room1"}]`))
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	recorder := tracetest.NewSpanRecorder()
+	previous := tracer
+	t.Cleanup(func() { tracer = previous })
+	tracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+
+	client := &http.Client{Transport: traceRequests(http.DefaultTransport)}
+	q := newQueueitAPI(context.Background(), zap.NewNop(), client, server.URL, "a-b-c", false)
+	q.poll()
+
+	spans := recorder.Ended()
+	// poll, discovery and its request, the room and its summary and detail requests
+	if want := 5 + DETAILS_METRIC_COUNT; len(spans) != want {
+		t.Fatalf("got %d spans, want %d", len(spans), want)
+	}
+
+	byName := map[string]int{}
+	var root trace.TraceID
+	for _, s := range spans {
+		byName[s.Name()]++
+		if s.Name() == "poll" {
+			root = s.SpanContext().TraceID()
+		}
+	}
+	for name, want := range map[string]int{"poll": 1, "discover waiting rooms": 1, "poll waiting room": 1, "queue-it POST /event/search": 1, "queue-it GET /summary": 1} {
+		if byName[name] != want {
+			t.Errorf("got %d %q spans, want %d", byName[name], name, want)
+		}
+	}
+
+	for _, s := range spans {
+		if s.SpanContext().TraceID() != root {
+			t.Errorf("span %q is not part of the poll trace", s.Name())
+		}
+
+		if s.SpanKind() != trace.SpanKindClient || s.Name() == "queue-it POST /event/search" {
+			continue
+		}
+
+		attrs := attribute.NewSet(s.Attributes()...)
+		if v, _ := attrs.Value(ATTRIBUTE_WAITING_ROOM_ID); v.AsString() != "room1" {
+			t.Errorf("span %q has waiting room id %q, want room1", s.Name(), v.AsString())
+		}
+		if v, _ := attrs.Value(ATTRIBUTE_ENDPOINT); v.AsString() == "" {
+			t.Errorf("span %q has no endpoint", s.Name())
+		}
+		if s.Name() != "queue-it GET /summary" {
+			if v, _ := attrs.Value(ATTRIBUTE_STATISTIC); v.AsString() == "" {
+				t.Errorf("span %q has no statistic", s.Name())
+			}
+		}
+	}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+)
+
+// Lifecycle events
+const (
+	EVENT_ROOM_APPEARED    = "room_appeared"
+	EVENT_PHASE_CHANGED    = "phase_changed"
+	EVENT_QUEUEING_STARTED = "queueing_started"
+	EVENT_QUEUE_DRAINED    = "queue_drained"
+	EVENT_ROOM_LEFT        = "room_left"
+	PHASE_QUEUE            = "queue"
+	SIGNATURE_HEADER       = "X-Queue-It-Exporter-Signature"
+	// outcome of deliveries given up on shutdown while waiting to retry
+	OUTCOME_CANCELLED = "cancelled"
+)
+
+var lifecycleEvents = []string{EVENT_ROOM_APPEARED, EVENT_PHASE_CHANGED, EVENT_QUEUEING_STARTED, EVENT_QUEUE_DRAINED, EVENT_ROOM_LEFT}
+
+// lifecycleEvent is a change of a waiting room seen between two polls. It is
+// the default webhook body and the data of body templates
+type lifecycleEvent struct {
+	Type                     string    `json:"type"`
+	Time                     time.Time `json:"time"`
+	RoomID                   string    `json:"waiting_room_id"`
+	DisplayName              string    `json:"display_name"`
+	Phase                    string    `json:"phase"`
+	PreviousPhase            string    `json:"previous_phase,omitempty"`
+	TotalWaitingInQueueCount float64   `json:"total_waiting_in_queue_count"`
+}
+
+// webhookConfig holds the webhooks flag
+type webhookConfig struct {
+	configFile string
+}
+
+// registerFlags adds the webhooks flag to a flag set
+func (c *webhookConfig) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.configFile, "webhooks.config-file", "", "Path to a YAML file of webhooks notified of waiting room lifecycle events")
+}
+
+// webhookFile is the webhooks configuration file
+type webhookFile struct {
+	Webhooks []*webhookTarget `yaml:"webhooks"`
+}
+
+// webhookTarget is a webhook notified of lifecycle events
+type webhookTarget struct {
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+	// events to send, every event when empty
+	Events []string `yaml:"events"`
+	// text/template of the request body, the JSON encoded event when empty
+	Body       string            `yaml:"body"`
+	Headers    map[string]string `yaml:"headers"`
+	SecretFile string            `yaml:"secret_file"`
+	MaxRetries int               `yaml:"max_retries"`
+	MinBackoff time.Duration     `yaml:"min_backoff"`
+	Timeout    time.Duration     `yaml:"timeout"`
+
+	body   *template.Template
+	secret []byte
+}
+
+// sends reports whether the target is subscribed to an event type
+func (t *webhookTarget) sends(event string) bool {
+	if len(t.Events) == 0 {
+		return true
+	}
+
+	for _, e := range t.Events {
+		if e == event {
+			return true
+		}
+	}
+
+	return false
+}
+
+// render returns the request body of an event
+func (t *webhookTarget) render(e *lifecycleEvent) ([]byte, error) {
+	if t.body == nil {
+		return json.Marshal(e)
+	}
+
+	var buf bytes.Buffer
+	if err := t.body.Execute(&buf, e); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// templateFuncs are available in body templates, json quotes a value for use in a JSON body
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// newNotifier loads the webhooks configuration file and returns a notifier
+// delivering events to its webhooks. It returns a nil notifier when no file
+// is configured
+func (c *webhookConfig) newNotifier(ctx context.Context, logger *zap.Logger) (*webhookNotifier, error) {
+	if c.configFile == "" {
+		return nil, nil
+	}
+
+	content, err := os.ReadFile(c.configFile)
+	if err != nil {
+		return nil, errors.New("cannot read file from webhooks.config-file: " + c.configFile)
+	}
+
+	var file webhookFile
+	if err := yaml.UnmarshalStrict(content, &file); err != nil {
+		return nil, fmt.Errorf("invalid webhooks.config-file: %w", err)
+	}
+
+	for i, t := range file.Webhooks {
+		if err := t.validate(); err != nil {
+			return nil, fmt.Errorf("invalid webhook %d in webhooks.config-file: %w", i, err)
+		}
+	}
+
+	return newWebhookNotifier(ctx, logger, file.Webhooks), nil
+}
+
+// validate checks a target and applies its defaults
+func (t *webhookTarget) validate() error {
+	if t.URL == "" {
+		return errors.New("missing url")
+	}
+
+	if t.Name == "" {
+		t.Name = t.URL
+	}
+
+	for _, e := range t.Events {
+		known := false
+		for _, l := range lifecycleEvents {
+			known = known || e == l
+		}
+		if !known {
+			return fmt.Errorf("unknown event %q, must be one of %s", e, strings.Join(lifecycleEvents, ", "))
+		}
+	}
+
+	if t.Body != "" {
+		body, err := template.New(t.Name).Funcs(templateFuncs).Parse(t.Body)
+		if err != nil {
+			return err
+		}
+		t.body = body
+	}
+
+	if t.SecretFile != "" {
+		content, err := os.ReadFile(t.SecretFile)
+		if err != nil {
+			return errors.New("cannot read secret_file: " + t.SecretFile)
+		}
+		t.secret = bytes.TrimSpace(content)
+	}
+
+	if t.MaxRetries == 0 {
+		t.MaxRetries = 3
+	}
+	if t.MinBackoff == 0 {
+		t.MinBackoff = time.Second
+	}
+	if t.Timeout == 0 {
+		t.Timeout = 10 * time.Second
+	}
+
+	return nil
+}
+
+// roomState is what lifecycle events are detected from
+type roomState struct {
+	displayName string
+	phase       string
+	waiting     float64
+	// whether waiting is known, the summary can fail
+	hasWaiting bool
+}
+
+// webhookNotifier detects lifecycle events between polls and delivers them to webhooks
+type webhookNotifier struct {
+	ctx        context.Context
+	logger     *zap.Logger
+	client     *http.Client
+	targets    []*webhookTarget
+	deliveries *prometheus.CounterVec
+
+	mu sync.Mutex
+	// room states of the last successful discovery, nil before the first one
+	rooms map[string]roomState
+}
+
+var webhookDeliveriesDefinition = &metricDefinition{
+	name:   "queue_it_webhook_deliveries_total",
+	help:   "Number of lifecycle event deliveries to webhooks by outcome.",
+	labels: []string{"webhook", "event", "outcome"},
+}
+
+// newWebhookNotifier returns a notifier delivering events to targets until ctx is done
+func newWebhookNotifier(ctx context.Context, logger *zap.Logger, targets []*webhookTarget) *webhookNotifier {
+	return &webhookNotifier{
+		ctx:        ctx,
+		logger:     logger,
+		client:     &http.Client{},
+		targets:    targets,
+		deliveries: webhookDeliveriesDefinition.counterVec(),
+	}
+}
+
+// register registers the notifier metrics to a registerer
+func (n *webhookNotifier) register(reg prometheus.Registerer) {
+	reg.MustRegister(n.deliveries)
+}
+
+// observe implements pollObserver. The rooms of the first poll are a baseline
+// and do not trigger events
+func (n *webhookNotifier) observe(p *poll) {
+	if !p.discovered {
+		return
+	}
+
+	n.mu.Lock()
+	previous := n.rooms
+	n.rooms = make(map[string]roomState, len(p.rooms))
+	events := make([]*lifecycleEvent, 0)
+
+	for _, r := range p.rooms {
+		state := roomState{displayName: r.room.DisplayName, phase: r.room.Phase}
+		for _, m := range r.metrics {
+			if m.queueitMetricName == "TotalWaitingInQueueCount" && m.err == nil {
+				state.waiting, state.hasWaiting = m.value, true
+			}
+		}
+
+		// keep the last known waiting count when the summary failed
+		before, seen := previous[r.room.EventID]
+		if !state.hasWaiting && seen {
+			state.waiting, state.hasWaiting = before.waiting, before.hasWaiting
+		}
+		n.rooms[r.room.EventID] = state
+
+		if previous == nil {
+			continue
+		}
+
+		newEvent := func(kind string) *lifecycleEvent {
+			return &lifecycleEvent{
+				Type:                     kind,
+				Time:                     r.start,
+				RoomID:                   r.room.EventID,
+				DisplayName:              r.room.DisplayName,
+				Phase:                    r.room.Phase,
+				PreviousPhase:            before.phase,
+				TotalWaitingInQueueCount: state.waiting,
+			}
+		}
+
+		if !seen {
+			events = append(events, newEvent(EVENT_ROOM_APPEARED))
+			if strings.EqualFold(state.phase, PHASE_QUEUE) {
+				events = append(events, newEvent(EVENT_QUEUEING_STARTED))
+			}
+			continue
+		}
+
+		if !strings.EqualFold(state.phase, before.phase) {
+			events = append(events, newEvent(EVENT_PHASE_CHANGED))
+			if strings.EqualFold(state.phase, PHASE_QUEUE) {
+				events = append(events, newEvent(EVENT_QUEUEING_STARTED))
+			}
+		}
+
+		if before.hasWaiting && before.waiting > 0 && state.hasWaiting && state.waiting == 0 {
+			events = append(events, newEvent(EVENT_QUEUE_DRAINED))
+		}
+	}
+
+	// rooms are only discovered in the searched phases, one that is no
+	// longer discovered left them, e.g. for the postqueue phase
+	for id, before := range previous {
+		if _, ok := n.rooms[id]; !ok {
+			events = append(events, &lifecycleEvent{
+				Type:                     EVENT_ROOM_LEFT,
+				Time:                     p.start,
+				RoomID:                   id,
+				DisplayName:              before.displayName,
+				PreviousPhase:            before.phase,
+				TotalWaitingInQueueCount: before.waiting,
+			})
+		}
+	}
+	n.mu.Unlock()
+
+	for _, e := range events {
+		for _, t := range n.targets {
+			if t.sends(e.Type) {
+				go n.deliver(t, e)
+			}
+		}
+	}
+}
+
+// deliver sends an event to a webhook, retrying on 5xx, 429 and network errors
+func (n *webhookNotifier) deliver(t *webhookTarget, e *lifecycleEvent) {
+	logger := n.logger.With(zap.String("webhook", t.Name), zap.String("event", e.Type), zap.String("waiting_room_id", e.RoomID))
+
+	body, err := t.render(e)
+	if err != nil {
+		logger.Error("webhookNotifier.deliver(): failed to render body", zap.Error(err))
+		n.deliveries.WithLabelValues(t.Name, e.Type, OUTCOME_ERROR).Inc()
+		return
+	}
+
+	backoff := t.MinBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := n.send(t, body)
+		if err == nil {
+			logger.Debug("webhookNotifier.deliver(): delivered event")
+			n.deliveries.WithLabelValues(t.Name, e.Type, OUTCOME_SUCCESS).Inc()
+			return
+		}
+
+		if !retry || attempt >= t.MaxRetries {
+			logger.Error("webhookNotifier.deliver(): failed to deliver event", zap.Int("attempts", attempt+1), zap.Error(err))
+			n.deliveries.WithLabelValues(t.Name, e.Type, OUTCOME_ERROR).Inc()
+			return
+		}
+
+		logger.Warn("webhookNotifier.deliver(): retrying failed delivery", zap.Int("attempt", attempt+1), zap.Duration("backoff", backoff), zap.Error(err))
+
+		select {
+		case <-n.ctx.Done():
+			logger.Warn("webhookNotifier.deliver(): gave up retrying on shutdown", zap.Int("attempts", attempt+1))
+			n.deliveries.WithLabelValues(t.Name, e.Type, OUTCOME_CANCELLED).Inc()
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// send executes a single webhook request and reports whether a failure is worth retrying
+func (n *webhookNotifier) send(t *webhookTarget, body []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(n.ctx, t.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", t.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", SERVICE_NAME+"/"+version)
+	for name, value := range t.Headers {
+		req.Header.Set(name, value)
+	}
+
+	if t.secret != nil {
+		req.Header.Set(SIGNATURE_HEADER, "sha256="+sign(t.secret, body))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+
+	err = fmt.Errorf("webhook returned HTTP status %s", resp.Status)
+	return resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+// sign returns the hex encoded HMAC-SHA256 of body
+func sign(secret []byte, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+// newTestPoll returns a successful poll of rooms, waiting maps room IDs to their TotalWaitingInQueueCount
+func newTestPoll(rooms []WaitingRoom, waiting map[string]float64) *poll {
+	p := &poll{start: time.Now(), discovered: true}
+	for _, room := range rooms {
+		p.rooms = append(p.rooms, &roomPoll{room: room, start: p.start, metrics: []*queueitMetric{
+			{queueitMetricName: "TotalWaitingInQueueCount", waitingRoomID: room.EventID, value: waiting[room.EventID]},
+		}})
+	}
+
+	return p
+}
+
+func TestWebhookNotifierEvents(t *testing.T) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var attempts int
+	received := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		// fail the first delivery once to exercise retries
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		if got, want := r.Header.Get(SIGNATURE_HEADER), "sha256="+sign([]byte("secret"), body); got != want {
+			t.Errorf("got signature %q, want %q", got, want)
+		}
+
+		var e struct{ Event, Room string }
+		if err := json.Unmarshal(body, &e); err != nil {
+			t.Errorf("body %q is not the rendered template: %v", body, err)
+		}
+		received = append(received, e.Room+" "+e.Event)
+		wg.Done()
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "secret")
+	os.WriteFile(secretFile, []byte("secret\n"), 0600)
+	configFile := filepath.Join(dir, "webhooks.yml")
+	os.WriteFile(configFile, []byte(`webhooks:
+  - name: test
+    url: `+server.URL+`
+    body: '{"event": {{json .Type}}, "room": {{json .RoomID}}}'
+    secret_file: `+secretFile+`
+    min_backoff: 1ms
+`), 0600)
+
+	cfg := &webhookConfig{configFile: configFile}
+	n, err := cfg.newNotifier(context.Background(), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prequeue := WaitingRoom{EventID: "drop", Phase: "prequeue"}
+	queue := WaitingRoom{EventID: "drop", Phase: "queue"}
+	other := WaitingRoom{EventID: "other", Phase: "queue"}
+
+	wg.Add(6)
+	// baseline, no event
+	n.observe(newTestPoll([]WaitingRoom{prequeue}, nil))
+	// room_appeared and queueing_started for other
+	n.observe(newTestPoll([]WaitingRoom{prequeue, other}, nil))
+	// failed discovery, no event
+	n.observe(&poll{})
+	// phase_changed and queueing_started for drop
+	n.observe(newTestPoll([]WaitingRoom{queue, other}, map[string]float64{"drop": 10}))
+	// queue_drained for drop
+	n.observe(newTestPoll([]WaitingRoom{queue, other}, map[string]float64{"drop": 0}))
+	// room_left for other, e.g. in the postqueue phase
+	n.observe(newTestPoll([]WaitingRoom{queue}, nil))
+	wg.Wait()
+
+	sort.Strings(received)
+	want := []string{
+		"drop phase_changed",
+		"drop queue_drained",
+		"drop queueing_started",
+		"other queueing_started",
+		"other room_appeared",
+		"other room_left",
+	}
+	if len(received) != len(want) {
+		t.Fatalf("got events %v, want %v", received, want)
+	}
+	for i := range want {
+		if received[i] != want[i] {
+			t.Errorf("got events %v, want %v", received, want)
+			break
+		}
+	}
+}
+
+func TestWebhookDeliveryCancelled(t *testing.T) {
+	attempted := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempted <- struct{}{}
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	configFile := filepath.Join(t.TempDir(), "webhooks.yml")
+	os.WriteFile(configFile, []byte("webhooks:\n  - name: test\n    url: "+server.URL+"\n    min_backoff: 1h\n"), 0600)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	n, err := (&webhookConfig{configFile: configFile}).newNotifier(ctx, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a delivery waiting to retry on shutdown is counted as cancelled
+	done := make(chan struct{})
+	go func() {
+		n.deliver(n.targets[0], &lifecycleEvent{Type: EVENT_QUEUE_DRAINED, RoomID: "drop"})
+		close(done)
+	}()
+	<-attempted
+	cancel()
+	<-done
+
+	if got := testutil.ToFloat64(n.deliveries.WithLabelValues("test", EVENT_QUEUE_DRAINED, OUTCOME_CANCELLED)); got != 1 {
+		t.Errorf("got %v cancelled deliveries, want 1", got)
+	}
+}
+
+func TestWebhookConfigValidation(t *testing.T) {
+	type test struct {
+		name   string
+		config string
+	}
+
+	tests := []test{
+		{name: "missing url", config: "webhooks:\n  - name: a\n"},
+		{name: "unknown event", config: "webhooks:\n  - url: http://localhost\n    events: [room_vanished]\n"},
+		{name: "bad template", config: "webhooks:\n  - url: http://localhost\n    body: '{{.Type'\n"},
+		{name: "unknown field", config: "webhooks:\n  - url: http://localhost\n    secret: foo\n"},
+	}
+
+	for _, tc := range tests {
+		configFile := filepath.Join(t.TempDir(), "webhooks.yml")
+		os.WriteFile(configFile, []byte(tc.config), 0600)
+
+		cfg := &webhookConfig{configFile: configFile}
+		if _, err := cfg.newNotifier(context.Background(), zap.NewNop()); err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+		}
+	}
+}